@@ -0,0 +1,98 @@
+// corridor.go: tiles along paths.
+
+package geography
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/PlaceDescriber/PlaceDescriber/types"
+)
+
+// MAX_LATITUDE is the latitude where Mercator tiles end.
+const MAX_LATITUDE = 85.05112878
+
+// Distance returns the great-circle distance between the points in metres.
+func Distance(a, b types.Point) float64 {
+	lat0, lat1 := a.Latitude*D_R, b.Latitude*D_R
+	sinLat := math.Sin((lat1 - lat0) / 2)
+	sinLong := math.Sin((b.Longitude - a.Longitude) * D_R / 2)
+	h := sinLat*sinLat + math.Cos(lat0)*math.Cos(lat1)*sinLong*sinLong
+	return 2 * R_MAJOR * math.Asin(math.Sqrt(math.Min(h, 1)))
+}
+
+// CorridorTileSet returns tiles of the zoom levels within buffer metres
+// of the line. The corridor is covered with boxes around points sampled
+// along the line, so it may have a few tiles more at its edges.
+func CorridorTileSet(line types.LineString, buffer float64, minZoom, maxZoom int, converter Conversion) (*TileSet, error) {
+	if len(line.Points) == 0 {
+		return nil, errors.New("Trying to build a corridor along LineString of 0 points.")
+	}
+	if buffer < 0 {
+		return nil, fmt.Errorf("Corridor buffer is negative: %v", buffer)
+	}
+	s := &TileSet{}
+	points := line.Points
+	for z := minZoom; z <= maxZoom; z++ {
+		// Samples are a quarter of a tile apart, boxes around them
+		// are widened by half of it to cover the gaps.
+		spacing := 2 * math.Pi * R_MAJOR / math.Exp2(float64(z)) / 4
+		s.addBox(z, points[0], buffer+spacing/2, converter)
+		for i := 1; i < len(points); i++ {
+			a, b := points[i-1], points[i]
+			n := int(math.Ceil(Distance(a, b) / spacing))
+			// Go the shorter way, across the antimeridian if needed.
+			dLong := wrapLongitude(b.Longitude - a.Longitude)
+			for k := 1; k <= n; k++ {
+				t := float64(k) / float64(n)
+				p := types.Point{
+					a.Latitude + (b.Latitude-a.Latitude)*t,
+					wrapLongitude(a.Longitude + dLong*t),
+				}
+				s.addBox(z, p, buffer+spacing/2, converter)
+			}
+		}
+	}
+	return s, nil
+}
+
+// wrapLongitude returns the longitude within -180..180.
+func wrapLongitude(long float64) float64 {
+	if long >= -180 && long <= 180 {
+		return long
+	}
+	return math.Mod(math.Mod(long+180, 360)+360, 360) - 180
+}
+
+// addBox adds tiles of the box of radius metres around the point,
+// a box crossing the antimeridian is added as two.
+func (s *TileSet) addBox(z int, p types.Point, radius float64, converter Conversion) {
+	dLat := radius / R_MAJOR * R_D
+	dLong := radius / (R_MAJOR * math.Max(math.Cos(p.Latitude*D_R), 1e-6)) * R_D
+	minLat := math.Max(p.Latitude-dLat, -MAX_LATITUDE)
+	maxLat := math.Min(p.Latitude+dLat, MAX_LATITUDE)
+	minLong, maxLong := p.Longitude-dLong, p.Longitude+dLong
+	switch {
+	case dLong >= 180:
+		minLong, maxLong = -180, 180
+	case minLong < -180:
+		s.addRange(z, minLat, maxLat, minLong+360, 180, converter)
+		minLong = -180
+	case maxLong > 180:
+		s.addRange(z, minLat, maxLat, -180, maxLong-360, converter)
+		maxLong = 180
+	}
+	s.addRange(z, minLat, maxLat, minLong, maxLong, converter)
+}
+
+// addRange adds tiles within the coordinates.
+func (s *TileSet) addRange(z int, minLat, maxLat, minLong, maxLong float64, converter Conversion) {
+	x0, y0 := converter.DegToTileNum(types.Point{maxLat, minLong}, z)
+	x1, y1 := converter.DegToTileNum(types.Point{minLat, maxLong}, z)
+	last := 1<<uint(z) - 1
+	clamp := func(n int) int {
+		return min(max(n, 0), last)
+	}
+	s.AddRect(z, clamp(min(x0, x1)), clamp(min(y0, y1)), clamp(max(x0, x1)), clamp(max(y0, y1)))
+}
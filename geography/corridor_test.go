@@ -0,0 +1,103 @@
+package geography
+
+import (
+	"math"
+	"testing"
+
+	"github.com/PlaceDescriber/PlaceDescriber/types"
+)
+
+func TestDistance(t *testing.T) {
+	// A degree of a meridian.
+	d := Distance(types.Point{10, 20}, types.Point{11, 20})
+	if math.Abs(d-111319.5) > 1 {
+		t.Errorf("Distance: got %v, want 111319.5.", d)
+	}
+	if d := Distance(types.Point{55.75, 37.62}, types.Point{55.75, 37.62}); d != 0 {
+		t.Errorf("Distance: got %v between the same points.", d)
+	}
+}
+
+func TestCorridorTileSet(t *testing.T) {
+	const (
+		ZOOM   = 14
+		BUFFER = 1000
+	)
+	// About 300 km diagonally.
+	line := types.LineString{
+		Points: []types.Point{
+			types.Point{55.75, 37.62},
+			types.Point{56.5, 38.5},
+			types.Point{57.63, 39.87},
+		},
+	}
+	converter := SphericalConversion{}
+	corridor, err := CorridorTileSet(line, BUFFER, ZOOM, ZOOM, converter)
+	if err != nil {
+		t.Fatalf("CorridorTileSet failed: %v.", err)
+	}
+	box, err := PolygonTileSet(types.Polygon{Vertices: line.Points}, ZOOM, ZOOM, converter)
+	if err != nil {
+		t.Fatalf("PolygonTileSet failed: %v.", err)
+	}
+	if corridor.Len()*10 > box.Len() {
+		t.Errorf("CorridorTileSet: %d tiles of %d in the bounding box.", corridor.Len(), box.Len())
+	}
+	// Points on the line and at the buffer are covered,
+	// points far from it are not.
+	for _, p := range []types.Point{
+		line.Points[0],
+		{56.125, 38.06},
+		{56.5 + 0.9*BUFFER/R_MAJOR*R_D, 38.5},
+		line.Points[2],
+	} {
+		x, y := converter.DegToTileNum(p, ZOOM)
+		if !corridor.Contains(ZOOM, x, y) {
+			t.Errorf("CorridorTileSet: point %v is not covered.", p)
+		}
+	}
+	x, y := converter.DegToTileNum(types.Point{56.5, 37.62}, ZOOM)
+	if corridor.Contains(ZOOM, x, y) {
+		t.Errorf("CorridorTileSet: point far from the line is covered.")
+	}
+	if _, err := CorridorTileSet(types.LineString{}, BUFFER, ZOOM, ZOOM, converter); err == nil {
+		t.Errorf("CorridorTileSet: empty line was accepted.")
+	}
+}
+
+func TestCorridorAntimeridian(t *testing.T) {
+	const (
+		ZOOM   = 10
+		BUFFER = 5000
+	)
+	converter := SphericalConversion{}
+	last := 1<<ZOOM - 1
+	// Across the Pacific, not around the world.
+	line := types.LineString{
+		Points: []types.Point{
+			types.Point{10, 179.5},
+			types.Point{10.5, -179.5},
+		},
+	}
+	corridor, err := CorridorTileSet(line, BUFFER, ZOOM, ZOOM, converter)
+	if err != nil {
+		t.Fatalf("CorridorAntimeridian: CorridorTileSet failed: %v.", err)
+	}
+	if corridor.Len() > 20 {
+		t.Errorf("CorridorAntimeridian: %d tiles along 110 km.", corridor.Len())
+	}
+	_, y := converter.DegToTileNum(types.Point{10.25, 180}, ZOOM)
+	if !corridor.Contains(ZOOM, 0, y) || !corridor.Contains(ZOOM, last, y) {
+		t.Errorf("CorridorAntimeridian: the antimeridian is not covered.")
+	}
+	// The buffer of a point at the antimeridian reaches the other side.
+	point := types.LineString{Points: []types.Point{{10, 179.99}}}
+	corridor, err = CorridorTileSet(point, BUFFER, ZOOM, ZOOM, converter)
+	if err != nil {
+		t.Fatalf("CorridorAntimeridian: CorridorTileSet failed: %v.", err)
+	}
+	_, y = converter.DegToTileNum(types.Point{10, 180}, ZOOM)
+	if !corridor.Contains(ZOOM, 0, y) || !corridor.Contains(ZOOM, last, y) || corridor.Len() > 10 {
+		t.Errorf("CorridorAntimeridian: %d tiles around the point.", corridor.Len())
+	}
+}
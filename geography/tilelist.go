@@ -0,0 +1,76 @@
+// tilelist.go: explicit lists of tiles.
+
+package geography
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// String returns the tile as z/x/y.
+func (t TileNum) String() string {
+	return fmt.Sprintf("%d/%d/%d", t.Z, t.X, t.Y)
+}
+
+// ParseTileNum parses a tile written as z/x/y.
+func ParseTileNum(s string) (TileNum, error) {
+	var t TileNum
+	var rest string
+	n, _ := fmt.Sscanf(s, "%d/%d/%d%s", &t.Z, &t.X, &t.Y, &rest)
+	if n != 3 {
+		return TileNum{}, fmt.Errorf("Bad tile %q, want z/x/y", s)
+	}
+	return t, nil
+}
+
+// UnmarshalJSON accepts either a z/x/y string or an object
+// with z, x and y.
+func (t *TileNum) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		tile, err := ParseTileNum(s)
+		if err != nil {
+			return err
+		}
+		*t = tile
+		return nil
+	}
+	type plain TileNum
+	return json.Unmarshal(data, (*plain)(t))
+}
+
+// ReadTileList reads a JSON array of tiles or z/x/y lines.
+// Empty lines and lines starting with # are skipped.
+func ReadTileList(r io.Reader) ([]TileNum, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) != 0 && trimmed[0] == '[' {
+		var tiles []TileNum
+		if err := json.Unmarshal(trimmed, &tiles); err != nil {
+			return nil, err
+		}
+		return tiles, nil
+	}
+	var tiles []TileNum
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		tile, err := ParseTileNum(text)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", line, err)
+		}
+		tiles = append(tiles, tile)
+	}
+	return tiles, scanner.Err()
+}
@@ -0,0 +1,501 @@
+// tileset.go: sets of tiles and their compact serialization.
+
+package geography
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/PlaceDescriber/PlaceDescriber/types"
+)
+
+const TILE_SET_VERSION = 1
+
+// Modes of zoom levels in serialized sets.
+const (
+	ZOOM_BITMAP = iota
+	ZOOM_LIST
+)
+
+// TileNum identifies a tile.
+type TileNum struct {
+	Z int `json:"z"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// chunk addresses 64 tiles of a column, from Y = Word*64.
+type chunk struct {
+	X    int
+	Word int
+}
+
+// TileSet is a set of tiles of any zoom levels. Tiles of a zoom level
+// are kept as bits of 64-tile words of columns, so dense areas take
+// little memory. The zero TileSet is empty and ready to use.
+type TileSet struct {
+	zooms map[int]map[chunk]uint64
+}
+
+// NewTileSet returns the set of the tiles.
+func NewTileSet(tiles ...TileNum) *TileSet {
+	s := &TileSet{}
+	for _, tile := range tiles {
+		s.Add(tile.Z, tile.X, tile.Y)
+	}
+	return s
+}
+
+// PolygonTileSet returns tiles of the zoom levels covering the polygon,
+// see PolygonTileRect.
+func PolygonTileSet(polygon types.Polygon, minZoom, maxZoom int, converter Conversion) (*TileSet, error) {
+	if _, _, _, _, err := polygon.ExtremeCoordinates(); err != nil {
+		return nil, err
+	}
+	s := &TileSet{}
+	for z := minZoom; z <= maxZoom; z++ {
+		r, err := PolygonTileRect(polygon, z, converter)
+		if err != nil {
+			return nil, err
+		}
+		s.AddRect(z, r.X0, r.Y0, r.X1, r.Y1)
+	}
+	return s, nil
+}
+
+// TileRect is tiles of a zoom level from X0/Y0 to X1/Y1 inclusive.
+// Unlike TileSet it takes no memory for its tiles.
+type TileRect struct {
+	Z  int
+	X0 int
+	Y0 int
+	X1 int
+	Y1 int
+}
+
+// PolygonTileRect returns tiles of the zoom level covering the polygon,
+// that is tiles within the extreme coordinates of its vertices.
+func PolygonTileRect(polygon types.Polygon, z int, converter Conversion) (TileRect, error) {
+	minLat, minLong, maxLat, maxLong, err := polygon.ExtremeCoordinates()
+	if err != nil {
+		return TileRect{}, err
+	}
+	x0, y0 := converter.DegToTileNum(types.Point{minLat, minLong}, z)
+	x1, y1 := converter.DegToTileNum(types.Point{maxLat, maxLong}, z)
+	return TileRect{z, min(x0, x1), min(y0, y1), max(x0, x1), max(y0, y1)}, nil
+}
+
+// Contains reports whether the tile is in the rectangle.
+func (r TileRect) Contains(z, x, y int) bool {
+	return z == r.Z && x >= r.X0 && x <= r.X1 && y >= r.Y0 && y <= r.Y1
+}
+
+// Len returns the number of tiles.
+func (r TileRect) Len() int {
+	return (r.X1 - r.X0 + 1) * (r.Y1 - r.Y0 + 1)
+}
+
+// Each calls f for the tiles ordered by X and Y until f returns false.
+func (r TileRect) Each(f func(tile TileNum) bool) {
+	for x := r.X0; x <= r.X1; x++ {
+		for y := r.Y0; y <= r.Y1; y++ {
+			if !f(TileNum{r.Z, x, y}) {
+				return
+			}
+		}
+	}
+}
+
+func (s *TileSet) zoom(z int, create bool) map[chunk]uint64 {
+	words := s.zooms[z]
+	if words == nil && create {
+		if s.zooms == nil {
+			s.zooms = make(map[int]map[chunk]uint64)
+		}
+		words = make(map[chunk]uint64)
+		s.zooms[z] = words
+	}
+	return words
+}
+
+// Add adds the tile to the set.
+func (s *TileSet) Add(z, x, y int) {
+	s.zoom(z, true)[chunk{x, y >> 6}] |= 1 << uint(y&63)
+}
+
+// AddRect adds tiles from x0/y0 to x1/y1 inclusive.
+func (s *TileSet) AddRect(z, x0, y0, x1, y1 int) {
+	if x0 > x1 || y0 > y1 {
+		return
+	}
+	words := s.zoom(z, true)
+	for x := x0; x <= x1; x++ {
+		for y := y0; y <= y1; {
+			// Fill the rest of the word at once.
+			last := min(y|63, y1)
+			mask := ^uint64(0) >> uint(63-(last-y)) << uint(y&63)
+			words[chunk{x, y >> 6}] |= mask
+			y = last + 1
+		}
+	}
+}
+
+// Remove removes the tile from the set.
+func (s *TileSet) Remove(z, x, y int) {
+	words := s.zoom(z, false)
+	key := chunk{x, y >> 6}
+	word, ok := words[key]
+	if !ok {
+		return
+	}
+	word &^= 1 << uint(y&63)
+	if word == 0 {
+		delete(words, key)
+		if len(words) == 0 {
+			delete(s.zooms, z)
+		}
+		return
+	}
+	words[key] = word
+}
+
+// Contains reports whether the tile is in the set.
+func (s *TileSet) Contains(z, x, y int) bool {
+	return s.zoom(z, false)[chunk{x, y >> 6}]&(1<<uint(y&63)) != 0
+}
+
+// Count returns the number of tiles of the zoom level.
+func (s *TileSet) Count(z int) int {
+	n := 0
+	for _, word := range s.zoom(z, false) {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+// Len returns the number of tiles.
+func (s *TileSet) Len() int {
+	n := 0
+	for z := range s.zooms {
+		n += s.Count(z)
+	}
+	return n
+}
+
+// Zooms returns zoom levels that have tiles in ascending order.
+func (s *TileSet) Zooms() []int {
+	zooms := make([]int, 0, len(s.zooms))
+	for z := range s.zooms {
+		zooms = append(zooms, z)
+	}
+	sort.Ints(zooms)
+	return zooms
+}
+
+// sortedChunks returns chunks of the zoom level ordered by X and Y.
+func (s *TileSet) sortedChunks(z int) []chunk {
+	words := s.zoom(z, false)
+	chunks := make([]chunk, 0, len(words))
+	for key := range words {
+		chunks = append(chunks, key)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		if chunks[i].X != chunks[j].X {
+			return chunks[i].X < chunks[j].X
+		}
+		return chunks[i].Word < chunks[j].Word
+	})
+	return chunks
+}
+
+// Each calls f for the tiles ordered by Z, X and Y until f returns false.
+// The set must not be changed by f.
+func (s *TileSet) Each(f func(tile TileNum) bool) {
+	for _, z := range s.Zooms() {
+		words := s.zooms[z]
+		for _, key := range s.sortedChunks(z) {
+			for word := words[key]; word != 0; word &= word - 1 {
+				y := key.Word<<6 + bits.TrailingZeros64(word)
+				if !f(TileNum{z, key.X, y}) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// Tiles returns the tiles ordered by Z, X and Y.
+func (s *TileSet) Tiles() []TileNum {
+	tiles := make([]TileNum, 0, s.Len())
+	s.Each(func(tile TileNum) bool {
+		tiles = append(tiles, tile)
+		return true
+	})
+	return tiles
+}
+
+// Clone returns a copy of the set.
+func (s *TileSet) Clone() *TileSet {
+	c := &TileSet{}
+	for z, words := range s.zooms {
+		copied := c.zoom(z, true)
+		for key, word := range words {
+			copied[key] = word
+		}
+	}
+	return c
+}
+
+// Union returns tiles that are in s or in o.
+func (s *TileSet) Union(o *TileSet) *TileSet {
+	u := s.Clone()
+	for z, words := range o.zooms {
+		united := u.zoom(z, true)
+		for key, word := range words {
+			united[key] |= word
+		}
+	}
+	return u
+}
+
+// Intersection returns tiles that are both in s and in o.
+func (s *TileSet) Intersection(o *TileSet) *TileSet {
+	i := &TileSet{}
+	for z, words := range s.zooms {
+		other := o.zoom(z, false)
+		for key, word := range words {
+			if word &= other[key]; word != 0 {
+				i.zoom(z, true)[key] = word
+			}
+		}
+	}
+	return i
+}
+
+// Difference returns tiles of s that are not in o.
+func (s *TileSet) Difference(o *TileSet) *TileSet {
+	d := &TileSet{}
+	for z, words := range s.zooms {
+		other := o.zoom(z, false)
+		for key, word := range words {
+			if word &^= other[key]; word != 0 {
+				d.zoom(z, true)[key] = word
+			}
+		}
+	}
+	return d
+}
+
+// Parents returns parents of the tiles, tiles of zoom 0 have none.
+func (s *TileSet) Parents() *TileSet {
+	p := &TileSet{}
+	s.Each(func(tile TileNum) bool {
+		if tile.Z > 0 {
+			p.Add(tile.Z-1, tile.X/2, tile.Y/2)
+		}
+		return true
+	})
+	return p
+}
+
+// Children returns the four children of each of the tiles.
+func (s *TileSet) Children() *TileSet {
+	c := &TileSet{}
+	s.Each(func(tile TileNum) bool {
+		c.AddRect(tile.Z+1, 2*tile.X, 2*tile.Y, 2*tile.X+1, 2*tile.Y+1)
+		return true
+	})
+	return c
+}
+
+// Expand returns the set with ancestors of the tiles down to minZoom
+// and their descendants up to maxZoom.
+func (s *TileSet) Expand(minZoom, maxZoom int) *TileSet {
+	e := s.Clone()
+	for level := s; level.Len() != 0; {
+		level = level.Parents()
+		for _, z := range level.Zooms() {
+			if z < minZoom {
+				delete(level.zooms, z)
+			}
+		}
+		e = e.Union(level)
+	}
+	for level := s; level.Len() != 0; {
+		level = level.Children()
+		for _, z := range level.Zooms() {
+			if z > maxZoom {
+				delete(level.zooms, z)
+			}
+		}
+		e = e.Union(level)
+	}
+	return e
+}
+
+// MarshalBinary encodes every zoom level as a bitmap of its bounding box
+// or as a list of tiles if the bitmap would be larger, and compresses
+// the result.
+func (s *TileSet) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(TILE_SET_VERSION)
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	zooms := s.Zooms()
+	data = binary.AppendUvarint(data, uint64(len(zooms)))
+	for _, z := range zooms {
+		data = s.appendZoom(data, z)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *TileSet) appendZoom(data []byte, z int) []byte {
+	count := s.Count(z)
+	minX, minY, maxX, maxY := -1, -1, 0, 0
+	level := &TileSet{zooms: map[int]map[chunk]uint64{z: s.zooms[z]}}
+	level.Each(func(tile TileNum) bool {
+		if minX < 0 || tile.X < minX {
+			minX = tile.X
+		}
+		if minY < 0 || tile.Y < minY {
+			minY = tile.Y
+		}
+		maxX, maxY = max(maxX, tile.X), max(maxY, tile.Y)
+		return true
+	})
+	width, height := int64(maxX-minX+1), int64(maxY-minY+1)
+	data = binary.AppendUvarint(data, uint64(z))
+	data = binary.AppendUvarint(data, uint64(count))
+	// A tile of a list takes a few bytes.
+	if width*height/8 > int64(count)*4 {
+		data = append(data, ZOOM_LIST)
+		prevX, prevY := 0, 0
+		level.Each(func(tile TileNum) bool {
+			data = binary.AppendUvarint(data, uint64(tile.X-prevX))
+			if tile.X == prevX {
+				data = binary.AppendUvarint(data, uint64(tile.Y-prevY))
+			} else {
+				data = binary.AppendUvarint(data, uint64(tile.Y))
+			}
+			prevX, prevY = tile.X, tile.Y
+			return true
+		})
+		return data
+	}
+	data = append(data, ZOOM_BITMAP)
+	for _, n := range []int{minX, minY, int(width), int(height)} {
+		data = binary.AppendUvarint(data, uint64(n))
+	}
+	bitmap := make([]byte, (width*height+7)/8)
+	level.Each(func(tile TileNum) bool {
+		i := int64(tile.X-minX)*height + int64(tile.Y-minY)
+		bitmap[i/8] |= 1 << uint(i%8)
+		return true
+	})
+	return append(data, bitmap...)
+}
+
+// UnmarshalBinary decodes the set encoded by MarshalBinary.
+func (s *TileSet) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 || data[0] != TILE_SET_VERSION {
+		return errors.New("Unknown TileSet encoding.")
+	}
+	// Sizes in the data are checked against the data left.
+	plain, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data[1:])))
+	if err != nil {
+		return fmt.Errorf("TileSet: %v", err)
+	}
+	r := bytes.NewReader(plain)
+	*s = TileSet{}
+	zooms, err := binary.ReadUvarint(r)
+	if err != nil {
+		return fmt.Errorf("TileSet: %v", err)
+	}
+	for i := uint64(0); i < zooms; i++ {
+		if err := s.readZoom(r); err != nil {
+			return fmt.Errorf("TileSet: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *TileSet) readZoom(r *bytes.Reader) error {
+	var header [2]uint64
+	for i := range header {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		header[i] = n
+	}
+	z, count := int(header[0]), int(header[1])
+	mode, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch mode {
+	case ZOOM_LIST:
+		x, y := 0, 0
+		for i := 0; i < count; i++ {
+			dx, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			if dx == 0 {
+				y += int(n)
+			} else {
+				x, y = x+int(dx), int(n)
+			}
+			s.Add(z, x, y)
+		}
+	case ZOOM_BITMAP:
+		var box [4]uint64
+		for i := range box {
+			n, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			box[i] = n
+		}
+		bitsLeft := uint64(r.Len()) * 8
+		if box[0] > math.MaxInt32 || box[1] > math.MaxInt32 ||
+			box[2] == 0 || box[3] == 0 || box[2] > bitsLeft || box[3] > bitsLeft/box[2] {
+			return fmt.Errorf("bad bitmap %dx%d at %d/%d of zoom %d", box[2], box[3], box[0], box[1], z)
+		}
+		minX, minY, width, height := int(box[0]), int(box[1]), int64(box[2]), int64(box[3])
+		bitmap := make([]byte, (width*height+7)/8)
+		if _, err := io.ReadFull(r, bitmap); err != nil {
+			return err
+		}
+		for i, b := range bitmap {
+			for ; b != 0; b &= b - 1 {
+				bit := int64(i)*8 + int64(bits.TrailingZeros8(b))
+				s.Add(z, minX+int(bit/height), minY+int(bit%height))
+			}
+		}
+	default:
+		return fmt.Errorf("unknown mode %d of zoom %d", mode, z)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package geography
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/PlaceDescriber/PlaceDescriber/types"
+)
+
+func TestTileSet(t *testing.T) {
+	s := NewTileSet(TileNum{1, 0, 1}, TileNum{2, 3, 3})
+	s.AddRect(2, 0, 60, 1, 70)
+	if s.Count(2) != 23 || s.Count(1) != 1 || s.Len() != 24 {
+		t.Errorf("TileSet: counts are %d and %d, want 23 and 1.", s.Count(2), s.Count(1))
+	}
+	if !s.Contains(2, 1, 64) || s.Contains(2, 2, 64) || s.Contains(2, 1, 71) {
+		t.Errorf("TileSet: Contains is wrong.")
+	}
+	tiles := s.Tiles()
+	if tiles[0] != (TileNum{1, 0, 1}) || tiles[1] != (TileNum{2, 0, 60}) || tiles[len(tiles)-1] != (TileNum{2, 3, 3}) {
+		t.Errorf("TileSet: wrong order %v.", tiles)
+	}
+	s.Remove(1, 0, 1)
+	if s.Len() != 23 || len(s.Zooms()) != 1 {
+		t.Errorf("TileSet: Remove left %v.", s.Zooms())
+	}
+}
+
+func TestTileSetOperations(t *testing.T) {
+	a, b := &TileSet{}, &TileSet{}
+	a.AddRect(5, 0, 0, 9, 9)
+	b.AddRect(5, 5, 5, 14, 14)
+	b.Add(6, 0, 0)
+	if n := a.Union(b).Len(); n != 100+100-25+1 {
+		t.Errorf("TileSet: union has %d tiles.", n)
+	}
+	if n := a.Intersection(b).Len(); n != 25 {
+		t.Errorf("TileSet: intersection has %d tiles.", n)
+	}
+	d := a.Difference(b)
+	if d.Len() != 75 || d.Contains(5, 5, 5) || !d.Contains(5, 4, 9) {
+		t.Errorf("TileSet: wrong difference of %d tiles.", d.Len())
+	}
+	if a.Len() != 100 || b.Len() != 101 {
+		t.Errorf("TileSet: operations changed operands.")
+	}
+	parents := a.Parents()
+	if parents.Count(4) != 25 || !parents.Contains(4, 4, 4) {
+		t.Errorf("TileSet: %d parents.", parents.Len())
+	}
+	if children := parents.Children(); children.Intersection(a).Len() != 100 || children.Len() != 100 {
+		t.Errorf("TileSet: children of parents are not the tiles.")
+	}
+	e := NewTileSet(TileNum{3, 5, 5}).Expand(1, 5)
+	if e.Count(1) != 1 || e.Count(2) != 1 || e.Count(3) != 1 || e.Count(4) != 4 || e.Count(5) != 16 || e.Count(0) != 0 {
+		t.Errorf("TileSet: wrong expansion %v.", e.Zooms())
+	}
+}
+
+func TestTileRect(t *testing.T) {
+	polygon := types.Polygon{
+		Vertices: []types.Point{
+			types.Point{55.1, 36.6},
+			types.Point{55.4, 37.0},
+		},
+	}
+	s, err := PolygonTileSet(polygon, 12, 12, SphericalConversion{})
+	if err != nil {
+		t.Fatalf("TileRect: PolygonTileSet failed: %v.", err)
+	}
+	r, err := PolygonTileRect(polygon, 12, SphericalConversion{})
+	if err != nil {
+		t.Fatalf("TileRect: PolygonTileRect failed: %v.", err)
+	}
+	if r.Len() != s.Len() {
+		t.Errorf("TileRect: %d tiles in the rectangle, %d in the set.", r.Len(), s.Len())
+	}
+	n := 0
+	r.Each(func(tile TileNum) bool {
+		if !s.Contains(tile.Z, tile.X, tile.Y) || !r.Contains(tile.Z, tile.X, tile.Y) {
+			t.Errorf("TileRect: tile %s is not in the set.", tile)
+		}
+		n++
+		return true
+	})
+	if n != r.Len() || r.Contains(13, r.X0, r.Y0) || r.Contains(12, r.X1+1, r.Y0) {
+		t.Errorf("TileRect: %d tiles of %v iterated.", n, r)
+	}
+}
+
+func TestTileSetMarshal(t *testing.T) {
+	polygon := types.Polygon{
+		Vertices: []types.Point{
+			types.Point{55.1, 36.6},
+			types.Point{55.4, 37.0},
+		},
+	}
+	s, err := PolygonTileSet(polygon, 10, 16, SphericalConversion{})
+	if err != nil {
+		t.Fatalf("TileSet: PolygonTileSet failed: %v.", err)
+	}
+	// A sparse zoom level is kept as a list.
+	s.Add(17, 0, 0)
+	s.Add(17, 1<<17-1, 1<<17-1)
+	data, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatalf("TileSet: MarshalBinary failed: %v.", err)
+	}
+	if len(data) > s.Len()/8+1000 {
+		t.Errorf("TileSet: %d tiles take %d bytes.", s.Len(), len(data))
+	}
+	var u TileSet
+	if err := u.UnmarshalBinary(data); err != nil {
+		t.Fatalf("TileSet: UnmarshalBinary failed: %v.", err)
+	}
+	if u.Len() != s.Len() || u.Difference(s).Len() != 0 {
+		t.Errorf("TileSet: got %d tiles after unmarshaling, want %d.", u.Len(), s.Len())
+	}
+	if err := u.UnmarshalBinary(data[:len(data)/2]); err == nil {
+		t.Errorf("TileSet: truncated data was accepted.")
+	}
+	// Bitmaps larger than the data, empty and overflowing are rejected.
+	for _, box := range [][4]uint64{{0, 0, 1 << 40, 1 << 40}, {0, 0, 0, 8}, {0, 0, 1 << 62, 1 << 62}, {1 << 63, 0, 1, 1}} {
+		plain := binary.AppendUvarint(nil, 1)
+		for _, n := range []uint64{10, 1, ZOOM_BITMAP, box[0], box[1], box[2], box[3]} {
+			plain = binary.AppendUvarint(plain, n)
+		}
+		plain = append(plain, 1)
+		var buf bytes.Buffer
+		buf.WriteByte(TILE_SET_VERSION)
+		w, _ := flate.NewWriter(&buf, flate.BestCompression)
+		w.Write(plain)
+		w.Close()
+		if err := u.UnmarshalBinary(buf.Bytes()); err == nil {
+			t.Errorf("TileSet: bitmap %v was accepted.", box)
+		}
+	}
+}
+
+func TestReadTileList(t *testing.T) {
+	want := []TileNum{{14, 8000, 5000}, {15, 16001, 10001}}
+	inputs := []string{
+		"14/8000/5000\n\n# From the access log.\n 15/16001/10001 \n",
+		`["14/8000/5000", {"z": 15, "x": 16001, "y": 10001}]`,
+	}
+	for _, input := range inputs {
+		tiles, err := ReadTileList(strings.NewReader(input))
+		if err != nil {
+			t.Fatalf("ReadTileList: %q failed: %v.", input, err)
+		}
+		if len(tiles) != len(want) || tiles[0] != want[0] || tiles[1] != want[1] {
+			t.Errorf("ReadTileList: got %v from %q, want %v.", tiles, input, want)
+		}
+	}
+	for _, input := range []string{"14/8000\n", "14/8000/5000.png\n", `["14/8000"]`} {
+		if _, err := ReadTileList(strings.NewReader(input)); err == nil {
+			t.Errorf("ReadTileList: %q was accepted.", input)
+		}
+	}
+}
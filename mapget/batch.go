@@ -0,0 +1,233 @@
+package mapget
+
+// batch.go: download of many maps sharing workers.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+// BatchEntry is a single map of a batch.
+type BatchEntry struct {
+	// Name identifies the entry in progress and errors.
+	Name    string         `json:"name"`
+	MapDesc MapDescription `json:"map_desc"`
+}
+
+// BatchSpec describes maps downloaded together. Entries share
+// the workers and the byte budget set by Params.
+type BatchSpec struct {
+	Params DownloadParams `json:"params"`
+	// RateLimits caps requests per second to providers, fallbacks
+	// included, providers that are not listed are not limited.
+	RateLimits map[string]float64 `json:"rate_limits"`
+	Entries    []BatchEntry       `json:"entries"`
+}
+
+// BatchTile is a tile of the entry with index Entry.
+type BatchTile struct {
+	Entry int
+	Tile  *geography.MapTile
+}
+
+// EntryStatus is returned by Batch.Status for every entry. Workers are
+// shared, so ActiveWorkers and WorkerLimit are reported for the batch
+// only.
+type EntryStatus struct {
+	Name string
+	JobStatus
+}
+
+// WithEntryProgress makes StartBatch call f every time the progress
+// of an entry changes. Calls are serialized.
+func WithEntryProgress(f func(entry int, p Progress)) Option {
+	return func(o *options) {
+		o.entryProgress = f
+	}
+}
+
+// Batch is a running download started by StartBatch.
+type Batch struct {
+	opts  *options
+	names []string
+	jobs  []*Job
+	done  chan struct{}
+	err   error
+
+	mtx      sync.Mutex
+	progress []Progress
+	workers  Progress
+}
+
+// StartBatch starts downloading entries of the spec in background.
+// Tiles of all entries are sent to out, out is closed when the batch
+// is over. A failed entry doesn't stop the others. Options apply to
+// all entries, except WithJournal, which is ignored, and WithProgress,
+// which gets the total over entries.
+func StartBatch(
+	ctx context.Context,
+	spec BatchSpec,
+	out chan<- *BatchTile,
+	client Loader,
+	opts ...Option,
+) *Batch {
+	o := newOptions(opts)
+	b := &Batch{
+		opts:     o,
+		done:     make(chan struct{}),
+		progress: make([]Progress, len(spec.Entries)),
+	}
+	if err := checkParams(spec.Params); err != nil {
+		o.logger.Error("Incorrect input", slog.Any("error", err))
+		b.err = err
+		close(out)
+		close(b.done)
+		return b
+	}
+	pool := newWorkerPool(spec.Params, func(active, limit int) {
+		b.mtx.Lock()
+		b.workers.ActiveWorkers = active
+		b.workers.WorkerLimit = limit
+		b.mtx.Unlock()
+		o.metrics.workers(active)
+	})
+	loader := rateLimited(client, spec.RateLimits)
+	var wg sync.WaitGroup
+	for i, entry := range spec.Entries {
+		entryOpts := *o
+		entryOpts.journal = nil
+		entryOpts.progress = b.reporter(i)
+		entryOpts.logger = o.logger.With(slog.String("entry", entry.Name))
+		tiles := make(chan *geography.MapTile)
+		b.names = append(b.names, entry.Name)
+		b.jobs = append(b.jobs, startJob(ctx, spec.Params, entry.MapDesc, tiles, loader, &entryOpts, pool))
+		wg.Add(1)
+		go func(entry int) {
+			defer wg.Done()
+			for tile := range tiles {
+				out <- &BatchTile{Entry: entry, Tile: tile}
+			}
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+		close(b.done)
+	}()
+	return b
+}
+
+// rateLimited limits requests of client to the providers by their
+// rates, providers are told by ProviderFromContext.
+func rateLimited(client Loader, rates map[string]float64) Loader {
+	loaders := make(map[string]Loader)
+	for provider, rate := range rates {
+		if rate > 0 {
+			loaders[provider] = Chain(client, RateLimitMiddleware(rate))
+		}
+	}
+	if len(loaders) == 0 {
+		return client
+	}
+	return LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		if loader, ok := loaders[ProviderFromContext(ctx)]; ok {
+			return loader.Do(ctx, url)
+		}
+		return client.Do(ctx, url)
+	})
+}
+
+// reporter returns the progress callback of the entry.
+func (b *Batch) reporter(entry int) func(Progress) {
+	return func(p Progress) {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		b.progress[entry] = p
+		if b.opts.entryProgress != nil {
+			b.opts.entryProgress(entry, p)
+		}
+		if b.opts.progress != nil {
+			b.opts.progress(b.total())
+		}
+	}
+}
+
+// total must be called with mtx held.
+func (b *Batch) total() Progress {
+	total := b.workers
+	for _, p := range b.progress {
+		total.Done += p.Done
+		total.Skipped += p.Skipped
+		total.Failed += p.Failed
+		total.Retries += p.Retries
+	}
+	return total
+}
+
+// Pause pauses all entries.
+func (b *Batch) Pause() {
+	for _, job := range b.jobs {
+		job.Pause()
+	}
+}
+
+// Resume continues all entries.
+func (b *Batch) Resume() {
+	for _, job := range b.jobs {
+		job.Resume()
+	}
+}
+
+// Cancel stops all entries, Wait returns ErrJobCancelled then.
+func (b *Batch) Cancel() {
+	for _, job := range b.jobs {
+		job.Cancel()
+	}
+}
+
+// Done returns a channel that is closed when the batch is over.
+func (b *Batch) Done() <-chan struct{} {
+	return b.done
+}
+
+// Wait blocks until the batch is over and returns errors of failed
+// entries joined, each prefixed with the name of the entry.
+func (b *Batch) Wait() error {
+	<-b.done
+	if b.err != nil {
+		return b.err
+	}
+	var errs []error
+	for i, job := range b.jobs {
+		switch err := job.Wait(); err {
+		case nil:
+		case ErrJobCancelled:
+			return err
+		default:
+			errs = append(errs, fmt.Errorf("%s: %w", b.names[i], err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Status returns the state and progress of every entry.
+func (b *Batch) Status() []EntryStatus {
+	statuses := make([]EntryStatus, len(b.jobs))
+	for i, job := range b.jobs {
+		statuses[i] = EntryStatus{Name: b.names[i], JobStatus: job.Status()}
+	}
+	return statuses
+}
+
+// Progress returns the total progress over entries.
+func (b *Batch) Progress() Progress {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.total()
+}
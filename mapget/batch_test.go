@@ -0,0 +1,114 @@
+package mapget
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+	"github.com/PlaceDescriber/PlaceDescriber/types"
+)
+
+func TestBatch(t *testing.T) {
+	registry := NewRegistry(MapProjects)
+	registry.Register("batchtest", TemplateMaps{
+		URLs: TypeToUrl{types.PLAN: "http://batchtest/{z}/{x}/{y}"},
+		// The same conversion as of Yandex for the same tiles.
+		Conversion: geography.EllipticalConversion{},
+	})
+	yandex := initMapDescription()
+	yandex.MaxZoom = 16
+	other := yandex
+	other.Provider = "batchtest"
+	bad := yandex
+	bad.Provider = "unknown"
+	spec := BatchSpec{
+		Params: DownloadParams{
+			GoroutinesNum: GOROUTINES_NUMBER,
+			TryTimes:      TRY_TIMES,
+		},
+		RateLimits: map[string]float64{"batchtest": 200},
+		Entries: []BatchEntry{
+			{Name: "yandex", MapDesc: yandex},
+			{Name: "other", MapDesc: other},
+			{Name: "bad", MapDesc: bad},
+		},
+	}
+	var mtx sync.Mutex
+	reported := make(map[int]int)
+	out := make(chan *BatchTile)
+	start := time.Now()
+	batch := StartBatch(context.Background(), spec, out, newTestLoader(0, 0),
+		WithRegistry(registry),
+		WithEntryProgress(func(entry int, p Progress) {
+			mtx.Lock()
+			reported[entry] = p.Done
+			mtx.Unlock()
+		}),
+	)
+	tiles := make(map[int]int)
+	for tile := range out {
+		tiles[tile.Entry]++
+	}
+	elapsed := time.Since(start)
+	if err := batch.Wait(); err == nil {
+		t.Errorf("Batch: didn't fail with a bad entry.")
+	}
+	statuses := batch.Status()
+	for i, status := range statuses[:2] {
+		if status.State != JOB_DONE {
+			t.Errorf("Batch: entry %s is %s, want done.", status.Name, status.State)
+		}
+		if tiles[i] == 0 || status.Progress.Done != tiles[i] || reported[i] != tiles[i] {
+			t.Errorf("Batch: entry %s got %d tiles, progress %d, reported %d.", status.Name, tiles[i], status.Progress.Done, reported[i])
+		}
+	}
+	if statuses[2].State != JOB_FAILED || statuses[2].Err == nil {
+		t.Errorf("Batch: bad entry is %s, want failed.", statuses[2].State)
+	}
+	if tiles[0] != tiles[1] {
+		t.Errorf("Batch: same areas have %d and %d tiles.", tiles[0], tiles[1])
+	}
+	if total := batch.Progress().Done; total != tiles[0]+tiles[1] {
+		t.Errorf("Batch: total progress is %d, want %d.", total, tiles[0]+tiles[1])
+	}
+	if min := time.Duration(tiles[1]-1) * time.Second / 200; elapsed < min {
+		t.Errorf("Batch: %d rate limited tiles took %v.", tiles[1], elapsed)
+	}
+}
+
+func TestBatchIncorrectParams(t *testing.T) {
+	out := make(chan *BatchTile)
+	spec := BatchSpec{Entries: []BatchEntry{{Name: "yandex", MapDesc: initMapDescription()}}}
+	batch := StartBatch(context.Background(), spec, out, newTestLoader(0, 0))
+	for _ = range out {
+	}
+	if err := batch.Wait(); err == nil {
+		t.Errorf("Batch: didn't fail on incorrect params.")
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	client := rateLimited(LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(url)), nil
+	}), map[string]float64{"slow": 10})
+	// Requests are limited by the provider requested.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		client.Do(WithProvider(context.Background(), "fast"), "url")
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("RateLimited: requests to an unlimited provider took %v.", elapsed)
+	}
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		client.Do(WithProvider(context.Background(), "slow"), "url")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("RateLimited: 3 requests at 10 per second took %v.", elapsed)
+	}
+}
@@ -0,0 +1,268 @@
+package mapget
+
+// cache.go: on-disk cache of responses keyed by URL.
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type cacheStateKey struct{}
+
+// cacheState is how caches served a request, it is passed with ctx,
+// so that middlewares wrapping bodies don't hide it.
+type cacheState struct {
+	// only makes the request served only from the cache
+	// given with WithCache.
+	only bool
+	hit  atomic.Bool
+}
+
+// withCacheState returns ctx in which caches report to state.
+func withCacheState(ctx context.Context, state *cacheState) context.Context {
+	return context.WithValue(ctx, cacheStateKey{}, state)
+}
+
+// cacheOnly reports whether the request of ctx is served only from
+// the cache given with WithCache.
+func cacheOnly(ctx context.Context) bool {
+	state, ok := ctx.Value(cacheStateKey{}).(*cacheState)
+	return ok && state.only
+}
+
+// cacheHit reports whether the request of ctx was served from a cache.
+func cacheHit(ctx context.Context) bool {
+	state, ok := ctx.Value(cacheStateKey{}).(*cacheState)
+	return ok && state.hit.Load()
+}
+
+// markCacheHit reports the request of ctx as served from a cache.
+func markCacheHit(ctx context.Context) {
+	if state, ok := ctx.Value(cacheStateKey{}).(*cacheState); ok {
+		state.hit.Store(true)
+	}
+}
+
+// ErrCacheMiss is returned in offline mode for URLs that are not cached.
+var ErrCacheMiss = errors.New("not in cache")
+
+type CacheParams struct {
+	// TTL is how long responses are served from the cache,
+	// zero means forever.
+	TTL time.Duration `json:"ttl"`
+	// MaxBytes caps the size of the cache, least recently used
+	// responses are evicted above it. Zero means no cap.
+	MaxBytes int64 `json:"max_bytes"`
+	// Offline serves only from the cache, expired responses included.
+	Offline bool `json:"offline"`
+}
+
+type cacheEntry struct {
+	key    string
+	size   int64
+	stored time.Time
+}
+
+// DiskCache stores responses in files named by the hash of the URL.
+// Use order is kept in memory, on open it is restored from the times
+// the responses were stored.
+type DiskCache struct {
+	dir    string
+	params CacheParams
+
+	mtx     sync.Mutex
+	entries map[string]*list.Element
+	// lru has the most recently used entries at the front.
+	lru  *list.List
+	size int64
+}
+
+// OpenDiskCache opens the cache in dir, creating dir if needed.
+func OpenDiskCache(dir string, params CacheParams) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		dir:     dir,
+		params:  params,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*cacheEntry
+	for _, file := range files {
+		stat, err := os.Stat(file)
+		if err != nil || !stat.Mode().IsRegular() || filepath.Ext(file) == ".tmp" {
+			continue
+		}
+		entries = append(entries, &cacheEntry{
+			key:    filepath.Base(file),
+			size:   stat.Size(),
+			stored: stat.ModTime(),
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].stored.After(entries[j].stored)
+	})
+	for _, entry := range entries {
+		c.entries[entry.key] = c.lru.PushBack(entry)
+		c.size += entry.size
+	}
+	// The cap may be lower than on the previous open.
+	c.evict()
+	return c, nil
+}
+
+func cacheKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *DiskCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// get returns the cached response, stale ones only if allowed.
+func (c *DiskCache) get(key string, allowStale bool) ([]byte, bool) {
+	c.mtx.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mtx.Unlock()
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !allowStale && c.params.TTL > 0 && time.Since(entry.stored) > c.params.TTL {
+		c.mtx.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	c.mtx.Unlock()
+	content, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		// Removed behind our back, forget it.
+		c.mtx.Lock()
+		c.remove(key)
+		c.mtx.Unlock()
+		return nil, false
+	}
+	return content, true
+}
+
+func (c *DiskCache) put(key string, content []byte) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that readers never
+	// see a partial response.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.remove(key)
+	entry := &cacheEntry{key: key, size: int64(len(content)), stored: time.Now()}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += entry.size
+	c.evict()
+	return nil
+}
+
+// remove must be called with mtx held, it doesn't touch the file.
+func (c *DiskCache) remove(key string) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.size -= elem.Value.(*cacheEntry).size
+	c.lru.Remove(elem)
+	delete(c.entries, key)
+}
+
+// evict must be called with mtx held.
+func (c *DiskCache) evict() {
+	for c.params.MaxBytes > 0 && c.size > c.params.MaxBytes {
+		entry := c.lru.Back().Value.(*cacheEntry)
+		c.remove(entry.key)
+		os.Remove(c.path(entry.key))
+	}
+}
+
+// Size returns the total size of cached responses.
+func (c *DiskCache) Size() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.size
+}
+
+// offlineLoader serves requests only from the cache.
+func (c *DiskCache) offlineLoader() Loader {
+	return c.Middleware()(LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		return nil, ErrCacheMiss
+	}))
+}
+
+// WithCache lets a job with quotas serve tiles from c after a quota
+// is used up, the loader isn't asked for them then. The middleware
+// of c is usually in the chain of the loader as well.
+func WithCache(c *DiskCache) Option {
+	return func(o *options) {
+		o.cache = c
+	}
+}
+
+// Middleware serves responses from the cache and caches
+// successful responses of the wrapped Loader.
+func (c *DiskCache) Middleware() Middleware {
+	return func(next Loader) Loader {
+		return LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+			key := cacheKey(url)
+			if content, ok := c.get(key, c.params.Offline); ok {
+				markCacheHit(ctx)
+				return ioutil.NopCloser(bytes.NewReader(content)), nil
+			}
+			if c.params.Offline {
+				return nil, ErrCacheMiss
+			}
+			body, err := next.Do(ctx, url)
+			if err != nil {
+				return nil, err
+			}
+			defer body.Close()
+			content, err := ioutil.ReadAll(body)
+			if err != nil {
+				return nil, err
+			}
+			// The response is good even if caching it failed.
+			c.put(key, content)
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package mapget
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingLoader returns the URL as content and counts requests.
+type countingLoader struct {
+	mtx      sync.Mutex
+	requests int
+}
+
+func (s *countingLoader) Do(ctx context.Context, url string) (io.ReadCloser, error) {
+	s.mtx.Lock()
+	s.requests++
+	s.mtx.Unlock()
+	return ioutil.NopCloser(strings.NewReader(url)), nil
+}
+
+func load(t *testing.T, client Loader, url string) (string, error) {
+	body, err := client.Do(context.Background(), url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("Cache: failed to read body: %v.", err)
+	}
+	return string(content), nil
+}
+
+func TestDiskCache(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := OpenDiskCache(dir, CacheParams{})
+	if err != nil {
+		t.Fatalf("Cache: OpenDiskCache failed: %v.", err)
+	}
+	next := &countingLoader{}
+	client := Chain(next, cache.Middleware())
+	for i := 0; i < 3; i++ {
+		if content, err := load(t, client, "http://a"); err != nil || content != "http://a" {
+			t.Fatalf("Cache: got %q, %v.", content, err)
+		}
+	}
+	if next.requests != 1 {
+		t.Errorf("Cache: %d requests for a cached URL, want 1.", next.requests)
+	}
+	// Responses survive reopening.
+	cache, err = OpenDiskCache(dir, CacheParams{Offline: true})
+	if err != nil {
+		t.Fatalf("Cache: OpenDiskCache failed: %v.", err)
+	}
+	client = Chain(next, cache.Middleware())
+	if content, err := load(t, client, "http://a"); err != nil || content != "http://a" {
+		t.Errorf("Cache: got %q, %v after reopening.", content, err)
+	}
+	if _, err := load(t, client, "http://b"); err != ErrCacheMiss {
+		t.Errorf("Cache: offline request of unknown URL returned %v.", err)
+	}
+	if next.requests != 1 {
+		t.Errorf("Cache: offline cache made requests.")
+	}
+}
+
+func TestDiskCacheTTL(t *testing.T) {
+	cache, err := OpenDiskCache(t.TempDir(), CacheParams{TTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("CacheTTL: OpenDiskCache failed: %v.", err)
+	}
+	next := &countingLoader{}
+	client := Chain(next, cache.Middleware())
+	load(t, client, "http://a")
+	load(t, client, "http://a")
+	time.Sleep(100 * time.Millisecond)
+	load(t, client, "http://a")
+	if next.requests != 2 {
+		t.Errorf("CacheTTL: %d requests, want 2.", next.requests)
+	}
+}
+
+func TestDiskCacheEviction(t *testing.T) {
+	// Each response is 8 bytes, so the cache holds two of them.
+	cache, err := OpenDiskCache(t.TempDir(), CacheParams{MaxBytes: 20})
+	if err != nil {
+		t.Fatalf("CacheEviction: OpenDiskCache failed: %v.", err)
+	}
+	next := &countingLoader{}
+	client := Chain(next, cache.Middleware())
+	load(t, client, "http://a")
+	load(t, client, "http://b")
+	load(t, client, "http://a")
+	load(t, client, "http://c")
+	if cache.Size() != 16 {
+		t.Errorf("CacheEviction: cache size is %d, want 16.", cache.Size())
+	}
+	// b was the least recently used one.
+	load(t, client, "http://a")
+	load(t, client, "http://b")
+	if next.requests != 4 {
+		t.Errorf("CacheEviction: %d requests, want 4.", next.requests)
+	}
+}
@@ -1,26 +1,41 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
-	"sync"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/PlaceDescriber/PlaceDescriber/geography"
 	"github.com/PlaceDescriber/PlaceDescriber/mapget"
 	"github.com/PlaceDescriber/PlaceDescriber/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
 	mapName       = flag.String("map-name", "", "Map name, will be used as sub-dir for tiles.")
 	coordinates   = flag.String("coordinates", "", "Path to JSON file describing what to download.")
+	layers        = flag.String("layers", "", "Path to JSON array of areas with zoom levels of their own to download instead of coordinates.")
+	route         = flag.String("route", "", "Path to JSON file with a route to download along instead of coordinates.")
+	buffer        = flag.Float64("buffer", 500, "Metres on either side of the route to download.")
+	tileList      = flag.String("tiles", "", "Path to z/x/y lines or a JSON array of tiles to download instead of coordinates.")
 	provider      = flag.String("provider", "yandex", "One of possible map providers.")
 	mapType       = flag.String("map-type", "satellite", "Map type.")
 	language      = flag.String("language", "en_EN", "Map language.")
@@ -30,6 +45,31 @@ var (
 	downloadDir   = flag.String("download-dir", "~/maps", "Directory for tiles.")
 	goroutinesNum = flag.Int("goroutines-num", 25, "Number of goroutines to use while loading.")
 	tryTimes      = flag.Int("try-times", 5, "Number of tries to download each of the tiles.")
+	jobsDir       = flag.String("jobs-dir", "~/maps/.jobs", "Directory for journals of jobs.")
+	rateLimit     = flag.Float64("rate-limit", 0, "Maximal number of requests per second, 0 means no limit.")
+	cacheDir      = flag.String("cache-dir", "", "Directory to cache responses in, empty means no cache.")
+	cacheTTL      = flag.Duration("cache-ttl", 0, "How long cached responses are used, 0 means forever.")
+	cacheSize     = flag.Int64("cache-size", 0, "Maximal size of the cache in megabytes, 0 means no limit.")
+	offline       = flag.Bool("offline", false, "Serve tiles only from the cache.")
+	record        = flag.String("record", "", "File to record HTTP responses to.")
+	replay        = flag.String("replay", "", "File with recorded HTTP responses to download from.")
+	logLevel      = flag.String("log-level", "warn", "Level of download logs: debug, info, warn or error.")
+	metricsAddr   = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. localhost:9100.")
+	adaptive      = flag.Bool("adaptive", false, "Adjust the number of active goroutines to the provider.")
+	minGoroutines = flag.Int("min-goroutines", 1, "Minimal number of active goroutines with adaptive option.")
+	maxGoroutines = flag.Int("max-goroutines", 100, "Maximal number of active goroutines with adaptive option.")
+	stream        = flag.Bool("stream", false, "Write tiles to files as they are downloaded, without verification.")
+	maxBytes      = flag.Int64("max-bytes-in-flight", 0, "Maximal megabytes of tiles held in memory, 0 means no limit.")
+	attemptTime   = flag.Duration("attempt-timeout", time.Minute, "Maximal duration of a single request, 0 means no limit.")
+	tileTime      = flag.Duration("tile-timeout", 0, "Maximal duration of all tries of a tile, 0 means no limit.")
+	jobTime       = flag.Duration("job-timeout", 0, "Maximal duration of the job, 0 means no limit.")
+	shard         = flag.String("shard", "", "Download only shard i/n of the tiles, e.g. 0/4, to split the map among processes.")
+	fallbacks     = flag.String("fallbacks", "", "Comma separated providers to try in order for tiles the provider fails to serve.")
+	placeholders  = flag.String("placeholders", "", "Comma separated image files of placeholders, tiles equal to them are requested from fallbacks.")
+	plugins       = flag.String("plugins", "", "Path to JSON array of providers backed by executables.")
+	quotas        = flag.String("quotas", "", "Path to JSON array of provider quotas, empty means no quotas.")
+	quotaFile     = flag.String("quota-file", "~/maps/.jobs/quotas.json", "File counting requests against the quotas.")
+	diffThreshold = flag.Float64("diff-threshold", 0, "Minimal share of pixels difference of changed tiles, 0 compares bytes only.")
 )
 
 const (
@@ -70,23 +110,54 @@ func makeDir(path string) error {
 	}
 	return nil
 }
-func main() {
-	flag.Parse()
+
+// controlledJob is a job or a batch.
+type controlledJob interface {
+	Pause()
+	Resume()
+	Cancel()
+	Done() <-chan struct{}
+}
+
+// handleSignals lets the operator pause the job with SIGUSR1,
+// resume it with SIGUSR2 and cancel it with SIGINT or SIGTERM.
+// report logs the state after every signal.
+func handleSignals(job controlledJob, report func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-job.Done():
+			return
+		case sig := <-signals:
+			switch sig {
+			case syscall.SIGUSR1:
+				job.Pause()
+			case syscall.SIGUSR2:
+				job.Resume()
+			default:
+				job.Cancel()
+			}
+			report()
+		}
+	}
+}
+
+func newJob() (*mapget.Journal, error) {
 	if len(*mapName) == 0 {
-		log.Fatalf("You must specify map name with map-name option.")
+		return nil, fmt.Errorf("you must specify map name with map-name option")
 	}
-	if len(*coordinates) == 0 {
-		log.Fatalf("You must specify path to JSON file with coordinates using coordinates option.")
+	if len(*coordinates) == 0 && len(*layers) == 0 && len(*route) == 0 && len(*tileList) == 0 {
+		return nil, fmt.Errorf("you must specify path to JSON file with coordinates using coordinates option, layers using layers option, a route using route option or a list of tiles using tiles option")
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	var wg sync.WaitGroup
 	typeO, ok := types.StrToMapType[*mapType]
 	if !ok {
 		fmt.Printf("Please specify correct map type. Possible types are:\n")
 		for key, _ := range types.StrToMapType {
 			fmt.Printf("%s\n", key)
 		}
-		log.Fatalf("Stopping now.")
+		return nil, fmt.Errorf("bad map type %s", *mapType)
 	}
 	mapDesc := mapget.MapDescription{
 		Provider: *provider,
@@ -96,20 +167,64 @@ func main() {
 		MaxZoom:  *maxZoom,
 		Scale:    *scale,
 	}
-	coordinatesFile, err := os.Open(*coordinates)
-	defer coordinatesFile.Close()
-	if err != nil {
-		log.Fatalf("Can't open map coordinates file: %v.", err)
+	if len(*fallbacks) != 0 {
+		mapDesc.Fallbacks = strings.Split(*fallbacks, ",")
 	}
-	data, err := ioutil.ReadAll(coordinatesFile)
-	if err != nil {
-		log.Fatalf("Can't read map coordinates file: %v.", err)
+	if len(*tileList) != 0 {
+		tilesFile, err := os.Open(*tileList)
+		if err != nil {
+			return nil, fmt.Errorf("can't open tiles file: %v", err)
+		}
+		defer tilesFile.Close()
+		mapDesc.Tiles, err = geography.ReadTileList(tilesFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read tiles file: %v", err)
+		}
+	} else if len(*layers) != 0 {
+		data, err := ioutil.ReadFile(*layers)
+		if err != nil {
+			return nil, fmt.Errorf("can't read layers file: %v", err)
+		}
+		if err := json.Unmarshal(data, &mapDesc.Layers); err != nil {
+			return nil, fmt.Errorf("can't parse layers file: %v", err)
+		}
+	} else if len(*route) != 0 {
+		data, err := ioutil.ReadFile(*route)
+		if err != nil {
+			return nil, fmt.Errorf("can't read route file: %v", err)
+		}
+		mapDesc.Route = &types.LineString{}
+		if err := json.Unmarshal(data, mapDesc.Route); err != nil {
+			return nil, fmt.Errorf("can't parse route file: %v", err)
+		}
+		mapDesc.Buffer = *buffer
+	} else {
+		coordinatesFile, err := os.Open(*coordinates)
+		if err != nil {
+			return nil, fmt.Errorf("can't open map coordinates file: %v", err)
+		}
+		defer coordinatesFile.Close()
+		data, err := ioutil.ReadAll(coordinatesFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't read map coordinates file: %v", err)
+		}
+		json.Unmarshal(data, &mapDesc.MapArea)
 	}
-	json.Unmarshal(data, &mapDesc.MapArea)
-	out := make(chan *geography.MapTile)
 	params := mapget.DownloadParams{
-		GoroutinesNum: *goroutinesNum,
-		TryTimes:      *tryTimes,
+		GoroutinesNum:    *goroutinesNum,
+		TryTimes:         *tryTimes,
+		Adaptive:         *adaptive,
+		MinGoroutines:    *minGoroutines,
+		MaxGoroutines:    *maxGoroutines,
+		MaxBytesInFlight: *maxBytes << 20,
+		AttemptTimeout:   *attemptTime,
+		TileTimeout:      *tileTime,
+		JobTimeout:       *jobTime,
+	}
+	if len(*shard) != 0 {
+		if _, err := fmt.Sscanf(*shard, "%d/%d", &params.Shard, &params.Shards); err != nil {
+			return nil, fmt.Errorf("bad shard %q, want i/n: %v", *shard, err)
+		}
 	}
 	path := fmt.Sprintf(
 		PATH_TEMPLATE,
@@ -120,43 +235,571 @@ func main() {
 		*language,
 		getCurTime(),
 	)
-	path, err = expandTilde(path)
+	path, err := expandTilde(path)
 	if err != nil {
-		log.Fatalf("Failed to expand ~ to home dir in path: %v.", err)
+		return nil, fmt.Errorf("failed to expand ~ to home dir in path: %v", err)
+	}
+	now := time.Now()
+	def := mapget.JobDefinition{
+		ID:      fmt.Sprintf("%s-%d", *mapName, now.Unix()),
+		MapDesc: mapDesc,
+		Params:  params,
+		Path:    path,
+		Created: now,
+	}
+	journalPath, err := getJournalPath(def.ID)
+	if err != nil {
+		return nil, err
+	}
+	journal, err := mapget.CreateJournal(journalPath, def)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Started job %s, continue it with resume %s if interrupted.", def.ID, def.ID)
+	return journal, nil
+}
+
+func getJournalPath(jobID string) (string, error) {
+	dir, err := expandTilde(*jobsDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to expand ~ to home dir in path: %v", err)
+	}
+	if err := makeDir(dir); err != nil {
+		return "", fmt.Errorf("failed to make/check jobs dir: %v", err)
+	}
+	return filepath.Join(dir, jobID+".journal"), nil
+}
+
+// verifyTile checks that the tile is an image.
+func verifyTile(tile *geography.MapTile) error {
+	if _, _, err := image.DecodeConfig(bytes.NewReader(tile.Content)); err != nil {
+		return fmt.Errorf("tile %d/%d/%d is not an image: %v", tile.Z, tile.X, tile.Y, err)
+	}
+	return nil
+}
+
+// storeTile writes the verified tile to the job directory.
+func storeTile(path string, tile *geography.MapTile, journal *mapget.Journal) error {
+	if err := journal.Record(tile.Z, tile.X, tile.Y, mapget.TILE_VERIFIED); err != nil {
+		return err
+	}
+	if err := writeTile(path, tile); err != nil {
+		return err
+	}
+	return journal.Record(tile.Z, tile.X, tile.Y, mapget.TILE_STORED)
+}
+
+// writeTile writes the tile to path/z/x/y.
+func writeTile(path string, tile *geography.MapTile) error {
+	tileDirPath := fmt.Sprintf("%s/%d/%d/", path, tile.Z, tile.X)
+	if err := makeDir(tileDirPath); err != nil {
+		return fmt.Errorf("failed to make/check tile dir: %v", err)
+	}
+	tileFileName := fmt.Sprintf("%d", tile.Y)
+	tileFile, err := os.Create(filepath.Join(tileDirPath, tileFileName))
+	if err != nil {
+		return fmt.Errorf("failed to creare tile file: %v", err)
+	}
+	_, err = tileFile.Write(tile.Content)
+	if err1 := tileFile.Close(); err == nil {
+		err = err1
 	}
-	wg.Add(1)
+	if err != nil {
+		return fmt.Errorf("failed to write to tile file: %v", err)
+	}
+	return nil
+}
+
+// serveMetrics exposes the download metrics on /metrics of addr.
+func serveMetrics(addr string) *mapget.Metrics {
+	registry := prometheus.NewRegistry()
+	metrics := mapget.NewMetrics(registry)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 	go func() {
-		defer wg.Done()
-		err = mapget.DownloadMap(
-			ctx,
-			params,
-			mapDesc,
-			out,
-			mapget.DefaultLoader{},
-		)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics server failed: %v.", err)
+		}
 	}()
-	for tile := range out {
-		tileDirPath := fmt.Sprintf("%s/%d/%d/", path, tile.Z, tile.X)
-		if err0 := makeDir(tileDirPath); err0 != nil {
-			log.Fatalf("Failed to make/check tile dir: %v.", err)
+	return metrics
+}
+
+// newLoader assembles the loader from the options. The cache, nil
+// without cache-dir, is returned for jobs with quotas and the replay
+// loader to report missing responses, closeLoader must be called
+// after the job.
+func newLoader() (client mapget.Loader, cache *mapget.DiskCache, replayLoader *mapget.ReplayLoader, closeLoader func(), err error) {
+	closeLoader = func() {}
+	var middlewares []mapget.Middleware
+	if len(*cacheDir) != 0 {
+		dir, err := expandTilde(*cacheDir)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to expand ~ to home dir in path: %v", err)
+		}
+		cache, err = mapget.OpenDiskCache(dir, mapget.CacheParams{
+			TTL:      *cacheTTL,
+			MaxBytes: *cacheSize << 20,
+			Offline:  *offline,
+		})
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to open the cache: %v", err)
+		}
+		middlewares = append(middlewares, cache.Middleware())
+	} else if *offline {
+		return nil, nil, nil, nil, fmt.Errorf("offline mode needs cache-dir")
+	}
+	if *rateLimit > 0 {
+		middlewares = append(middlewares, mapget.RateLimitMiddleware(*rateLimit))
+	}
+	client = mapget.DefaultLoader{}
+	switch {
+	case len(*record) != 0 && len(*replay) != 0:
+		return nil, nil, nil, nil, fmt.Errorf("record and replay can't be used together")
+	case len(*record) != 0:
+		recordFile, err := os.Create(*record)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to create the recording: %v", err)
+		}
+		closeLoader = func() {
+			if err := recordFile.Close(); err != nil {
+				log.Printf("Failed to close the recording: %v.", err)
+			}
+		}
+		client = mapget.DefaultLoader{
+			Client: &http.Client{Transport: mapget.NewRecorder(recordFile, nil)},
+		}
+	case len(*replay) != 0:
+		replayFile, err := os.Open(*replay)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to open the recording: %v", err)
+		}
+		replayLoader, err = mapget.OpenReplay(replayFile)
+		replayFile.Close()
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("failed to read the recording: %v", err)
+		}
+		client = replayLoader
+	}
+	return mapget.Chain(client, middlewares...), cache, replayLoader, closeLoader, nil
+}
+
+// reportMissing logs the requests that were not in the recording.
+func reportMissing(replayLoader *mapget.ReplayLoader) {
+	if replayLoader == nil {
+		return
+	}
+	for _, url := range replayLoader.Missing() {
+		log.Printf("Not in the recording: %s.", url)
+	}
+}
+
+// placeholderOption makes the job use fallbacks for tiles equal
+// to the placeholder files, it is nil without them.
+func placeholderOption() (mapget.Option, error) {
+	if len(*placeholders) == 0 {
+		return nil, nil
+	}
+	if *stream {
+		// Streamed tiles are written before they could be checked.
+		return nil, fmt.Errorf("placeholders option can't be used with stream option")
+	}
+	var contents [][]byte
+	for _, path := range strings.Split(*placeholders, ",") {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read placeholder: %v", err)
+		}
+		contents = append(contents, content)
+	}
+	return mapget.WithPlaceholder(func(tile *geography.MapTile) bool {
+		for _, content := range contents {
+			if bytes.Equal(tile.Content, content) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// startPlugins starts providers backed by executables and registers
+// them in the registry, closePlugins stops them.
+func startPlugins(registry *mapget.Registry) (closePlugins func(), err error) {
+	closePlugins = func() {}
+	if len(*plugins) == 0 {
+		return closePlugins, nil
+	}
+	data, err := ioutil.ReadFile(*plugins)
+	if err != nil {
+		return nil, fmt.Errorf("can't read plugins: %v", err)
+	}
+	var list []mapget.PluginParams
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("can't parse plugins: %v", err)
+	}
+	var started []*mapget.PluginMaps
+	closePlugins = func() {
+		for _, plugin := range started {
+			plugin.Close()
+		}
+	}
+	for _, params := range list {
+		plugin, err := mapget.StartPlugin(params)
+		if err != nil {
+			closePlugins()
+			return nil, err
+		}
+		started = append(started, plugin)
+		registry.Register(params.Name, plugin)
+	}
+	return closePlugins, nil
+}
+
+// openQuotas opens the quota file if quotas are given, it returns
+// nil otherwise.
+func openQuotas() (*mapget.Quotas, error) {
+	if len(*quotas) == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(*quotas)
+	if err != nil {
+		return nil, fmt.Errorf("can't read quotas: %v", err)
+	}
+	var list []mapget.Quota
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("can't parse quotas: %v", err)
+	}
+	path, err := expandTilde(*quotaFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand ~ to home dir in path: %v", err)
+	}
+	if err := makeDir(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("failed to make/check quota file dir: %v", err)
+	}
+	return mapget.OpenQuotas(path, list)
+}
+
+// closeQuotas writes the final usage of quotas.
+func closeQuotas(q *mapget.Quotas) {
+	if err := q.Close(); err != nil {
+		log.Printf("Failed to write the quota file: %v.", err)
+	}
+}
+
+// warnQuotas warns about providers that are estimated to need
+// more tiles than are left of their quotas.
+func warnQuotas(q *mapget.Quotas, estimates map[string]int) {
+	for provider, n := range estimates {
+		if left, ok := q.Remaining(provider); ok && n > left {
+			log.Printf("Warning: about %d tiles of %s are needed, %d are left of its quota. The job will stop when the quota is used up.", n, provider, left)
+		}
+	}
+}
+
+// addEstimate adds the tiles of the map to the estimates of its
+// provider and of its fallbacks, which may be asked for every tile.
+func addEstimate(estimates map[string]int, mapDesc mapget.MapDescription, n int) {
+	estimates[mapDesc.Provider] += n
+	for _, fallback := range mapDesc.Fallbacks {
+		estimates[fallback] += n
+	}
+}
+
+func runJob(journal *mapget.Journal, registry *mapget.Registry, metrics *mapget.Metrics, logger *slog.Logger) error {
+	def := journal.Definition()
+	client, cache, replayLoader, closeLoader, err := newLoader()
+	if err != nil {
+		return err
+	}
+	defer closeLoader()
+	// Missing responses explain failures of the job, so they are
+	// reported on every return.
+	defer reportMissing(replayLoader)
+	quotas, err := openQuotas()
+	if err != nil {
+		return err
+	}
+	defer closeQuotas(quotas)
+	withPlaceholder, err := placeholderOption()
+	if err != nil {
+		return err
+	}
+	if quotas != nil {
+		n, err := mapget.EstimateTiles(def.MapDesc, def.Params, mapget.WithJournal(journal), mapget.WithRegistry(registry))
+		if err != nil {
+			return err
 		}
-		tileFileName := fmt.Sprintf("%d", tile.Y)
-		tileFile, err0 := os.Create(filepath.Join(tileDirPath, tileFileName))
-		if err0 != nil {
-			cancel()
-			wg.Wait()
-			log.Fatalf("Failed to creare tile file: %v", err0)
+		estimates := make(map[string]int)
+		addEstimate(estimates, def.MapDesc, n)
+		warnQuotas(quotas, estimates)
+	}
+	workerLimit := 0
+	finished := make(map[int]bool)
+	reportProgress := func(p mapget.Progress) {
+		if p.WorkerLimit != workerLimit {
+			workerLimit = p.WorkerLimit
+			log.Printf("Working with %d goroutines, %d tiles done.", workerLimit, p.Done)
 		}
-		_, err0 = tileFile.Write(tile.Content)
-		if err0 != nil {
-			cancel()
-			wg.Wait()
-			log.Fatalf("Failed to write to tile file: %v", err0)
+		for i, layer := range p.Layers {
+			if !finished[i] && layer.Done+layer.Skipped+layer.Failed == layer.Total {
+				finished[i] = true
+				log.Printf("Layer %s is over: %d tiles done, %d skipped, %d failed.", layer.Name, layer.Done, layer.Skipped, layer.Failed)
+			}
 		}
-		tileFile.Close()
 	}
-	wg.Wait()
+	opts := []mapget.Option{
+		mapget.WithLoader(client),
+		mapget.WithProgress(reportProgress),
+		mapget.WithJournal(journal),
+		mapget.WithMetrics(metrics),
+		mapget.WithLogger(logger),
+		mapget.WithQuotas(quotas),
+		mapget.WithCache(cache),
+		mapget.WithRegistry(registry),
+	}
+	if withPlaceholder != nil {
+		opts = append(opts, withPlaceholder)
+	}
+	if *stream {
+		// The job stores and records tiles itself then.
+		opts = append(opts, mapget.WithStore(mapget.DirStore{Path: def.Path}))
+	}
+	tiles := mapget.Download(context.Background(), def.MapDesc, def.Params, opts...)
+	defer tiles.Close()
+	job := tiles.Job()
+	go handleSignals(job, func() {
+		status := job.Status()
+		log.Printf("Job is %s, %d tiles done.", status.State, status.Progress.Done)
+		for _, layer := range status.Progress.Layers {
+			log.Printf("Layer %s has %d of %d tiles done.", layer.Name, layer.Done+layer.Skipped, layer.Total)
+		}
+	})
+	invalid := 0
+	for tiles.Next() {
+		if *stream {
+			continue
+		}
+		tile := tiles.Tile()
+		if err := verifyTile(tile); err != nil {
+			// Leave it to be downloaded again on resume.
+			log.Printf("Skipping invalid tile: %v.", err)
+			invalid++
+			continue
+		}
+		if err := storeTile(def.Path, tile, journal); err != nil {
+			return err
+		}
+	}
+	if err := tiles.Err(); err != nil {
+		if errors.Is(err, mapget.ErrQuotaExceeded) {
+			return fmt.Errorf("%v, resume job %s when the quota is renewed", err, def.ID)
+		}
+		return fmt.Errorf("DownloadMap: %v", err)
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d tiles failed verification, resume job %s to download them again", invalid, def.ID)
+	}
+	return nil
+}
+
+// runBatch downloads all maps of the batch spec, every entry
+// to the directory of its name.
+func runBatch(specPath string, registry *mapget.Registry, metrics *mapget.Metrics, logger *slog.Logger) error {
+	data, err := ioutil.ReadFile(specPath)
 	if err != nil {
-		log.Fatalf("DownloadMap: %v.", err)
+		return fmt.Errorf("can't read batch spec: %v", err)
 	}
+	var spec mapget.BatchSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("can't parse batch spec: %v", err)
+	}
+	paths := make([]string, len(spec.Entries))
+	for i, entry := range spec.Entries {
+		path := fmt.Sprintf(
+			PATH_TEMPLATE,
+			*downloadDir,
+			entry.Name,
+			entry.MapDesc.Provider,
+			types.MapTypeToStr[entry.MapDesc.Type],
+			entry.MapDesc.Language,
+			getCurTime(),
+		)
+		paths[i], err = expandTilde(path)
+		if err != nil {
+			return fmt.Errorf("failed to expand ~ to home dir in path: %v", err)
+		}
+	}
+	client, cache, replayLoader, closeLoader, err := newLoader()
+	if err != nil {
+		return err
+	}
+	defer closeLoader()
+	defer reportMissing(replayLoader)
+	quotas, err := openQuotas()
+	if err != nil {
+		return err
+	}
+	defer closeQuotas(quotas)
+	if quotas != nil {
+		estimates := make(map[string]int)
+		for _, entry := range spec.Entries {
+			n, err := mapget.EstimateTiles(entry.MapDesc, spec.Params, mapget.WithRegistry(registry))
+			if err != nil {
+				return fmt.Errorf("entry %s: %v", entry.Name, err)
+			}
+			addEstimate(estimates, entry.MapDesc, n)
+		}
+		warnQuotas(quotas, estimates)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out := make(chan *mapget.BatchTile)
+	batch := mapget.StartBatch(
+		ctx,
+		spec,
+		out,
+		client,
+		mapget.WithMetrics(metrics),
+		mapget.WithLogger(logger),
+		mapget.WithQuotas(quotas),
+		mapget.WithCache(cache),
+		mapget.WithRegistry(registry),
+	)
+	go handleSignals(batch, func() {
+		progress := batch.Progress()
+		log.Printf("Batch has %d tiles done, %d failed.", progress.Done, progress.Failed)
+	})
+	invalid := 0
+	for batchTile := range out {
+		tile := batchTile.Tile
+		if err := verifyTile(tile); err != nil {
+			log.Printf("Skipping invalid tile of %s: %v.", spec.Entries[batchTile.Entry].Name, err)
+			invalid++
+			continue
+		}
+		if err := writeTile(paths[batchTile.Entry], tile); err != nil {
+			batch.Cancel()
+			for _ = range out {
+			}
+			return err
+		}
+	}
+	for _, status := range batch.Status() {
+		if status.Err != nil {
+			log.Printf("Entry %s failed after %d tiles: %v.", status.Name, status.Progress.Done, status.Err)
+		} else {
+			log.Printf("Entry %s is %s, %d tiles done.", status.Name, status.State, status.Progress.Done)
+		}
+	}
+	if err := batch.Wait(); err != nil {
+		return fmt.Errorf("StartBatch: %v", err)
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d tiles failed verification", invalid)
+	}
+	return nil
+}
+
+// diffSnapshots writes GeoJSON of tiles that differ in two snapshots
+// of the provider to stdout.
+func diffSnapshots(registry *mapget.Registry, oldPath, newPath string) error {
+	mapProj, ok := registry.Lookup(*provider)
+	if !ok {
+		return fmt.Errorf("bad map provider %s", *provider)
+	}
+	changes, err := mapget.DiffSnapshots(oldPath, newPath, *diffThreshold)
+	if err != nil {
+		return err
+	}
+	data, err := mapget.ChangesGeoJSON(changes, mapProj.Converter())
+	if err != nil {
+		return err
+	}
+	counts := make(map[mapget.ChangeKind]int)
+	for _, change := range changes {
+		counts[change.Kind]++
+	}
+	log.Printf("%d tiles added, %d removed, %d changed.",
+		counts[mapget.TILE_ADDED], counts[mapget.TILE_REMOVED], counts[mapget.TILE_CHANGED])
+	_, err = os.Stdout.Write(append(data, '\n'))
+	return err
+}
+
+// newLogger makes the logger of downloads from the options.
+func newLogger() *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Fatalf("Bad log level: %v.", err)
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+func main() {
+	flag.Parse()
+	var metrics *mapget.Metrics
+	if len(*metricsAddr) != 0 {
+		metrics = serveMetrics(*metricsAddr)
+	}
+	logger := newLogger()
+	registry := mapget.NewRegistry(mapget.MapProjects)
+	closePlugins, err := startPlugins(registry)
+	if err != nil {
+		log.Fatalf("Failed to start plugins: %v.", err)
+	}
+	err = run(registry, metrics, logger)
+	// log.Fatalf doesn't run deferred calls.
+	closePlugins()
+	if err != nil {
+		log.Fatalf("%v.", err)
+	}
+}
+
+// run runs the command given in the arguments.
+func run(registry *mapget.Registry, metrics *mapget.Metrics, logger *slog.Logger) error {
+	var journal *mapget.Journal
+	var err error
+	switch flag.Arg(0) {
+	case "":
+		journal, err = newJob()
+	case "diff":
+		if flag.NArg() != 3 {
+			return fmt.Errorf("usage: %s [options] diff <old-dir> <new-dir>", os.Args[0])
+		}
+		if err := diffSnapshots(registry, flag.Arg(1), flag.Arg(2)); err != nil {
+			return fmt.Errorf("diff failed: %v", err)
+		}
+		return nil
+	case "batch":
+		if flag.NArg() != 2 {
+			return fmt.Errorf("usage: %s [options] batch <spec-file>", os.Args[0])
+		}
+		if err := runBatch(flag.Arg(1), registry, metrics, logger); err != nil {
+			return fmt.Errorf("batch failed: %v", err)
+		}
+		return nil
+	case "resume":
+		if flag.NArg() != 2 {
+			return fmt.Errorf("usage: %s [options] resume <job-id>", os.Args[0])
+		}
+		var journalPath string
+		journalPath, err = getJournalPath(flag.Arg(1))
+		if err == nil {
+			journal, err = mapget.OpenJournal(journalPath)
+		}
+		if err == nil {
+			log.Printf("Resuming job %s, %d tiles are already stored.", flag.Arg(1), journal.Count(mapget.TILE_STORED))
+		}
+	default:
+		return fmt.Errorf("unknown command %s", flag.Arg(0))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to prepare the job: %v", err)
+	}
+	err = runJob(journal, registry, metrics, logger)
+	if err1 := journal.Close(); err1 != nil {
+		log.Printf("Failed to close the journal: %v.", err1)
+	}
+	if err != nil {
+		return fmt.Errorf("job failed: %v", err)
+	}
+	return nil
 }
@@ -0,0 +1,255 @@
+package mapget
+
+// concurrency.go: AIMD control of the number of active workers
+// and progress accounting.
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Share of failed attempts in a window that is still healthy.
+	MAX_ERROR_RATE = 0.1
+	// Average latency above LATENCY_FACTOR * best latency means
+	// the provider is overloaded.
+	LATENCY_FACTOR = 3.0
+	// Weight of the latest attempt in average latency.
+	LATENCY_WEIGHT = 0.2
+	// Minimal interval between two decreases, so that a burst of
+	// errors from the same overload halves the limit only once.
+	DECREASE_COOLDOWN = time.Second
+)
+
+// aimdController limits the number of workers downloading at the same
+// time. The limit grows by one after each window of healthy attempts and
+// is halved on throttling, server errors, timeouts or too slow responses.
+// Without Adaptive the limit stays at GoroutinesNum.
+type aimdController struct {
+	mtx      sync.Mutex
+	adaptive bool
+	min      int
+	max      int
+	limit    int
+	active   int
+	// Slots are waited for on wake, it is closed and replaced
+	// every time active or limit changes.
+	wake chan struct{}
+	// Statistics of the current window.
+	attempts     int
+	errors       int
+	bestLatency  time.Duration
+	avgLatency   time.Duration
+	lastDecrease time.Time
+	onChange     func(active, limit int)
+}
+
+func newController(params DownloadParams, onChange func(active, limit int)) *aimdController {
+	c := &aimdController{
+		adaptive: params.Adaptive,
+		min:      params.GoroutinesNum,
+		max:      params.GoroutinesNum,
+		limit:    params.GoroutinesNum,
+		wake:     make(chan struct{}),
+		onChange: onChange,
+	}
+	if params.Adaptive {
+		c.min, c.max = params.MinGoroutines, params.MaxGoroutines
+	}
+	return c
+}
+
+// notify must be called with mtx held.
+func (c *aimdController) notify() {
+	close(c.wake)
+	c.wake = make(chan struct{})
+	if c.onChange != nil {
+		c.onChange(c.active, c.limit)
+	}
+}
+
+// acquire blocks until the worker is allowed to take a task.
+func (c *aimdController) acquire(ctx context.Context) error {
+	for {
+		c.mtx.Lock()
+		if c.active < c.limit {
+			c.active++
+			c.notify()
+			c.mtx.Unlock()
+			return nil
+		}
+		wake := c.wake
+		c.mtx.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+// hold takes a slot without waiting, even above the limit,
+// for a worker that releases it right away.
+func (c *aimdController) hold() {
+	c.mtx.Lock()
+	c.active++
+	c.notify()
+	c.mtx.Unlock()
+}
+
+func (c *aimdController) release() {
+	c.mtx.Lock()
+	c.active--
+	c.notify()
+	c.mtx.Unlock()
+}
+
+// observe accounts the result of a single download attempt.
+func (c *aimdController) observe(ctx context.Context, latency time.Duration, err error) {
+	if !c.adaptive || ctx.Err() != nil {
+		// Cancelled attempts say nothing about the provider.
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if isOverload(err) {
+		c.decrease()
+		return
+	}
+	c.attempts++
+	if err != nil {
+		c.errors++
+	} else {
+		if c.bestLatency == 0 || latency < c.bestLatency {
+			c.bestLatency = latency
+		}
+		if c.avgLatency == 0 {
+			c.avgLatency = latency
+		}
+		c.avgLatency = time.Duration(LATENCY_WEIGHT*float64(latency) + (1-LATENCY_WEIGHT)*float64(c.avgLatency))
+	}
+	if c.attempts < c.limit {
+		return
+	}
+	healthy := float64(c.errors)/float64(c.attempts) <= MAX_ERROR_RATE &&
+		float64(c.avgLatency) <= LATENCY_FACTOR*float64(c.bestLatency)
+	if healthy {
+		c.attempts, c.errors = 0, 0
+		if c.limit < c.max {
+			c.limit++
+			c.notify()
+		}
+	} else {
+		c.decrease()
+	}
+}
+
+// decrease must be called with mtx held.
+func (c *aimdController) decrease() {
+	c.attempts, c.errors = 0, 0
+	now := time.Now()
+	if now.Sub(c.lastDecrease) < DECREASE_COOLDOWN {
+		return
+	}
+	c.lastDecrease = now
+	// Forget the average, it was measured under overload.
+	c.avgLatency = 0
+	limit := max(c.limit/2, c.min)
+	if limit != c.limit {
+		c.limit = limit
+		c.notify()
+	}
+}
+
+// isOverload reports whether err means that the provider
+// asks to slow down.
+func isOverload(err error) bool {
+	if err == nil {
+		return false
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode >= 500
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ErrAttemptTimeout) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// progressTracker collects Progress and reports it.
+type progressTracker struct {
+	mtx      sync.Mutex
+	progress Progress
+	report   func(Progress)
+}
+
+func (t *progressTracker) update(f func(p *Progress)) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	f(&t.progress)
+	if t.report != nil {
+		t.report(t.progress.clone())
+	}
+}
+
+// setLayers starts tracking progress of the layers with the numbers
+// of tiles the job has of them.
+func (t *progressTracker) setLayers(layers []AreaLayer, totals []int) {
+	t.update(func(p *Progress) {
+		p.Layers = make([]LayerProgress, len(layers))
+		for i, layer := range layers {
+			p.Layers[i] = LayerProgress{Name: layer.Name, Total: totals[i]}
+		}
+	})
+}
+
+// done counts a tile, layers are indices of the layers having it.
+func (t *progressTracker) done(layers []int) {
+	t.update(func(p *Progress) {
+		p.Done++
+		for _, i := range layers {
+			p.Layers[i].Done++
+		}
+	})
+}
+
+func (t *progressTracker) skip(layers []int) {
+	t.update(func(p *Progress) {
+		p.Skipped++
+		for _, i := range layers {
+			p.Layers[i].Skipped++
+		}
+	})
+}
+
+func (t *progressTracker) fail(layers []int) {
+	t.update(func(p *Progress) {
+		p.Failed++
+		for _, i := range layers {
+			p.Layers[i].Failed++
+		}
+	})
+}
+
+func (t *progressTracker) retry() {
+	t.update(func(p *Progress) { p.Retries++ })
+}
+
+func (t *progressTracker) workers(active, limit int) {
+	t.update(func(p *Progress) {
+		p.ActiveWorkers = active
+		p.WorkerLimit = limit
+	})
+}
+
+func (t *progressTracker) snapshot() Progress {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.progress.clone()
+}
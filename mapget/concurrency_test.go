@@ -0,0 +1,110 @@
+package mapget
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+func adaptiveParams() DownloadParams {
+	return DownloadParams{
+		GoroutinesNum: 4,
+		TryTimes:      TRY_TIMES,
+		Adaptive:      true,
+		MinGoroutines: 2,
+		MaxGoroutines: 8,
+	}
+}
+
+func TestControllerIncrease(t *testing.T) {
+	ctrl := newController(adaptiveParams(), nil)
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		ctrl.observe(ctx, time.Millisecond, nil)
+	}
+	if ctrl.limit != 8 {
+		t.Errorf("Controller: limit is %d after healthy attempts, want 8.", ctrl.limit)
+	}
+}
+
+func TestControllerDecrease(t *testing.T) {
+	ctrl := newController(adaptiveParams(), nil)
+	ctx := context.Background()
+	throttled := &HTTPError{StatusCode: http.StatusTooManyRequests}
+	ctrl.observe(ctx, time.Millisecond, throttled)
+	if ctrl.limit != 2 {
+		t.Fatalf("Controller: limit is %d after throttling, want 2.", ctrl.limit)
+	}
+	ctrl.lastDecrease = time.Time{}
+	ctrl.observe(ctx, time.Millisecond, throttled)
+	if ctrl.limit != 2 {
+		t.Errorf("Controller: limit is %d, went below minimum 2.", ctrl.limit)
+	}
+}
+
+func TestControllerErrorRate(t *testing.T) {
+	ctrl := newController(adaptiveParams(), nil)
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		ctrl.observe(ctx, time.Millisecond, errors.New("Error."))
+	}
+	if ctrl.limit != 2 {
+		t.Errorf("Controller: limit is %d after failing window, want 2.", ctrl.limit)
+	}
+}
+
+func TestControllerFixed(t *testing.T) {
+	params := adaptiveParams()
+	params.Adaptive = false
+	ctrl := newController(params, nil)
+	ctrl.observe(context.Background(), time.Millisecond, &HTTPError{StatusCode: 503})
+	if ctrl.limit != 4 {
+		t.Errorf("Controller: non-adaptive limit changed to %d.", ctrl.limit)
+	}
+}
+
+func TestAdaptiveDownload(t *testing.T) {
+	var wg sync.WaitGroup
+	var err error
+	var last Progress
+	out := make(chan *geography.MapTile)
+	loader := newTestLoader(1, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = DownloadMap(
+			context.Background(),
+			adaptiveParams(),
+			initMapDescription(),
+			out,
+			loader,
+			WithProgress(func(p Progress) {
+				// Workers above a decreased limit finish their
+				// tiles, so only the maximum is strict.
+				if p.ActiveWorkers > 8 || p.WorkerLimit > 8 {
+					t.Errorf("AdaptiveDownload: %d active workers with limit %d.", p.ActiveWorkers, p.WorkerLimit)
+				}
+				last = p
+			}),
+		)
+	}()
+	tiles := 0
+	for _ = range out {
+		tiles++
+	}
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("AdaptiveDownload: DownloadMap failed: %v.", err)
+	}
+	if last.Done != tiles {
+		t.Errorf("AdaptiveDownload: progress reports %d tiles, got %d.", last.Done, tiles)
+	}
+	if last.Retries != 1 {
+		t.Errorf("AdaptiveDownload: progress reports %d retries, want 1.", last.Retries)
+	}
+}
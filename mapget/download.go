@@ -0,0 +1,132 @@
+package mapget
+
+// download.go: downloads without channels.
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+// WithLoader makes Download and DownloadToStore request tiles with
+// client, DefaultLoader is used by default.
+func WithLoader(client Loader) Option {
+	return func(o *options) {
+		o.loader = client
+	}
+}
+
+func (o *options) client() Loader {
+	if o.loader == nil {
+		return DefaultLoader{}
+	}
+	return o.loader
+}
+
+// TileIterator iterates over tiles of a download started by Download:
+//
+//	it := Download(ctx, mapDesc, params)
+//	defer it.Close()
+//	for it.Next() {
+//		tile := it.Tile()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type TileIterator struct {
+	job  *Job
+	out  chan *geography.MapTile
+	tile *geography.MapTile
+	err  error
+}
+
+// Download starts downloading the map and returns the iterator
+// over its tiles.
+func Download(ctx context.Context, mapDesc MapDescription, params DownloadParams, opts ...Option) *TileIterator {
+	o := newOptions(opts)
+	out := make(chan *geography.MapTile)
+	return &TileIterator{
+		job: startJob(ctx, params, mapDesc, out, o.client(), o, nil),
+		out: out,
+	}
+}
+
+// Next waits for the next tile, it returns false when the download
+// is over.
+func (it *TileIterator) Next() bool {
+	tile, ok := <-it.out
+	if !ok {
+		it.tile = nil
+		it.err = it.job.Wait()
+		return false
+	}
+	it.tile = tile
+	return true
+}
+
+// Tile returns the tile read by the last Next.
+func (it *TileIterator) Tile() *geography.MapTile {
+	return it.tile
+}
+
+// Err returns the error of the download once Next returned false.
+func (it *TileIterator) Err() error {
+	return it.err
+}
+
+// Job returns the handle of the download, e.g. to pause it.
+func (it *TileIterator) Job() *Job {
+	return it.job
+}
+
+// Close stops the download if it is not over yet. It must be called
+// if the iteration is stopped before Next returns false.
+func (it *TileIterator) Close() {
+	it.job.Cancel()
+	for _ = range it.out {
+	}
+}
+
+// Summary is returned by DownloadToStore.
+type Summary struct {
+	Progress
+	// Outcomes counts tiles by their outcome.
+	Outcomes map[Outcome]int
+	Duration time.Duration
+}
+
+// DownloadToStore downloads the map to the store and returns
+// the summary of the download.
+func DownloadToStore(
+	ctx context.Context,
+	mapDesc MapDescription,
+	params DownloadParams,
+	store Store,
+	opts ...Option,
+) (Summary, error) {
+	start := time.Now()
+	summary := Summary{Outcomes: make(map[Outcome]int)}
+	o := newOptions(opts)
+	o.store = store
+	var mtx sync.Mutex
+	results := o.results
+	o.results = func(r Result) {
+		mtx.Lock()
+		summary.Outcomes[r.Outcome]++
+		mtx.Unlock()
+		if results != nil {
+			results(r)
+		}
+	}
+	out := make(chan *geography.MapTile)
+	job := startJob(ctx, params, mapDesc, out, o.client(), o, nil)
+	for _ = range out {
+	}
+	err := job.Wait()
+	summary.Progress = job.Status().Progress
+	summary.Duration = time.Since(start)
+	return summary, err
+}
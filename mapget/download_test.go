@@ -0,0 +1,64 @@
+package mapget
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestTileIterator(t *testing.T) {
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	it := Download(context.Background(), initMapDescription(), params, WithLoader(newTestLoader(1, 1)))
+	defer it.Close()
+	tiles := 0
+	for it.Next() {
+		if len(it.Tile().Content) == 0 {
+			t.Errorf("TileIterator: tile has no content.")
+		}
+		tiles++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("TileIterator: download failed: %v.", err)
+	}
+	if done := it.Job().Status().Progress.Done; tiles == 0 || done != tiles {
+		t.Errorf("TileIterator: got %d tiles, %d done.", tiles, done)
+	}
+
+	// Stopping early cancels the download.
+	it = Download(context.Background(), initMapDescription(), params, WithLoader(newTestLoader(0, 0)))
+	it.Next()
+	it.Close()
+	if err := it.Job().Wait(); err != ErrJobCancelled {
+		t.Errorf("TileIterator: Close left %v, want ErrJobCancelled.", err)
+	}
+	it = Download(context.Background(), initMapDescription(), params, WithLoader(newTestLoader(1, TRY_TIMES)))
+	for it.Next() {
+	}
+	var tileErr *TileError
+	if !errors.As(it.Err(), &tileErr) {
+		t.Errorf("TileIterator: got %v, want TileError.", it.Err())
+	}
+}
+
+func TestDownloadToStore(t *testing.T) {
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	dir := t.TempDir()
+	summary, err := DownloadToStore(context.Background(), initMapDescription(), params, DirStore{Path: dir}, WithLoader(newTestLoader(1, 1)))
+	if err != nil {
+		t.Fatalf("DownloadToStore failed: %v.", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*"))
+	if len(files) == 0 || summary.Done != len(files) || summary.Outcomes[OUTCOME_DOWNLOADED] != len(files) {
+		t.Errorf("DownloadToStore: %d files stored, summary is %+v.", len(files), summary)
+	}
+	if summary.Retries != 1 || summary.Duration <= 0 {
+		t.Errorf("DownloadToStore: wrong summary %+v.", summary)
+	}
+}
@@ -0,0 +1,72 @@
+package mapget
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+	"github.com/PlaceDescriber/PlaceDescriber/mapget/tiletest"
+	"github.com/PlaceDescriber/PlaceDescriber/types"
+)
+
+// serveProvider returns the registry with the provider of the test server.
+func serveProvider(name string, server *tiletest.Server) *Registry {
+	registry := NewRegistry(MapProjects)
+	registry.Register(name, TemplateMaps{
+		URLs:       TypeToUrl{types.PLAN: server.Template()},
+		Conversion: geography.SphericalConversion{},
+	})
+	return registry
+}
+
+func TestDefaultLoader(t *testing.T) {
+	var wg sync.WaitGroup
+	var err error
+	server := tiletest.NewServer(tiletest.Params{
+		Latency:      time.Millisecond,
+		ErrorRate:    0.1,
+		ThrottleRate: 0.02,
+		RetryAfter:   time.Second,
+		Seed:         1,
+	})
+	defer server.Close()
+	registry := serveProvider("tiletest", server)
+	mapDesc := initMapDescription()
+	mapDesc.Provider = "tiletest"
+	mapDesc.MaxZoom = 17
+	out := make(chan *geography.MapTile)
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = DownloadMap(context.Background(), params, mapDesc, out, DefaultLoader{}, WithRegistry(registry))
+	}()
+	tiles := 0
+	for tile := range out {
+		tiles++
+		if !bytes.Equal(tile.Content, tiletest.Tile(tile.Z, tile.X, tile.Y)) {
+			t.Errorf("DefaultLoader: got wrong image for tile %d/%d/%d.", tile.Z, tile.X, tile.Y)
+		}
+		if _, err := png.Decode(bytes.NewReader(tile.Content)); err != nil {
+			t.Errorf("DefaultLoader: tile is not PNG: %v.", err)
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("DefaultLoader: DownloadMap failed: %v.", err)
+	}
+	if ok := server.Requests(http.StatusOK); ok != tiles {
+		t.Errorf("DefaultLoader: server sent %d tiles, got %d.", ok, tiles)
+	}
+	if server.Requests(http.StatusInternalServerError) == 0 {
+		t.Errorf("DefaultLoader: no failures were injected.")
+	}
+}
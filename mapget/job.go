@@ -0,0 +1,342 @@
+package mapget
+
+// job.go: handle for controlling a running download.
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+type JobState int
+
+const (
+	JOB_RUNNING JobState = iota
+	JOB_PAUSED
+	JOB_CANCELLED
+	JOB_DONE
+	JOB_FAILED
+)
+
+var JobStateToStr = map[JobState]string{
+	JOB_RUNNING:   "running",
+	JOB_PAUSED:    "paused",
+	JOB_CANCELLED: "cancelled",
+	JOB_DONE:      "done",
+	JOB_FAILED:    "failed",
+}
+
+func (s JobState) String() string {
+	return JobStateToStr[s]
+}
+
+// JobStatus is returned by Job.Status.
+type JobStatus struct {
+	State    JobState
+	Progress Progress
+	// Err is set once the job has failed.
+	Err error
+}
+
+// ErrJobCancelled is returned by Job.Wait after Job.Cancel.
+var ErrJobCancelled = errors.New("job cancelled")
+
+// Job is a running download started by StartJob.
+type Job struct {
+	params  DownloadParams
+	mapDesc MapDescription
+	out     chan<- *geography.MapTile
+	client  Loader
+	opts    *options
+	ctrl    *aimdController
+	tracker *progressTracker
+	gate    *pauseGate
+	budget  *byteBudget
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	mtx sync.Mutex
+	// errs are errors of tasks, errors caused by cancellation
+	// after them are not collected.
+	errs      []error
+	cancelled bool
+}
+
+// StartJob starts downloading the map in background and returns
+// the handle of the download. Tiles are sent to out, out is closed
+// when the job is over.
+func StartJob(
+	ctx context.Context,
+	params DownloadParams,
+	mapDesc MapDescription,
+	out chan<- *geography.MapTile,
+	client Loader,
+	opts ...Option,
+) *Job {
+	return startJob(ctx, params, mapDesc, out, client, newOptions(opts), nil)
+}
+
+// startJob starts the job with workers of the pool,
+// a pool of its own is made if pool is nil.
+func startJob(
+	ctx context.Context,
+	params DownloadParams,
+	mapDesc MapDescription,
+	out chan<- *geography.MapTile,
+	client Loader,
+	o *options,
+	pool *workerPool,
+) *Job {
+	ctx, stopTimeout := withTimeout(ctx, params.JobTimeout, ErrJobTimeout)
+	jobCtx, cancel := context.WithCancel(ctx)
+	j := &Job{
+		params:  params,
+		mapDesc: mapDesc,
+		out:     out,
+		client:  client,
+		opts:    o,
+		tracker: &progressTracker{report: o.progress},
+		gate:    &pauseGate{},
+		cancel: func() {
+			cancel()
+			stopTimeout()
+		},
+		done: make(chan struct{}),
+	}
+	if err := checkInput(mapDesc, params, o.registry); err != nil {
+		o.logger.Error("Incorrect input", slog.Any("error", err))
+		j.errs = []error{err}
+		j.cancel()
+		close(out)
+		close(j.done)
+		return j
+	}
+	o.logger.Info("Starting download",
+		slog.String("provider", mapDesc.Provider),
+		slog.Int("min_zoom", mapDesc.MinZoom),
+		slog.Int("max_zoom", mapDesc.MaxZoom),
+	)
+	if pool == nil {
+		pool = newWorkerPool(params, func(active, limit int) {
+			j.tracker.workers(active, limit)
+			o.metrics.workers(active)
+		})
+	}
+	j.ctrl = pool.ctrl
+	j.budget = pool.budget
+	go j.run(ctx, jobCtx)
+	return j
+}
+
+// addErr collects the error of a task unless the task was stopped
+// by cancellation of ctx.
+func (j *Job) addErr(ctx context.Context, err error) {
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		return
+	}
+	j.mtx.Lock()
+	j.errs = append(j.errs, err)
+	j.mtx.Unlock()
+}
+
+// err must be called with mtx held.
+func (j *Job) err() error {
+	if len(j.errs) == 1 {
+		return j.errs[0]
+	}
+	return errors.Join(j.errs...)
+}
+
+// run runs the job in ctx derived from parent.
+func (j *Job) run(parent, ctx context.Context) {
+	var wg sync.WaitGroup
+	// Let task creation stay ahead of the workers.
+	tasks := make(chan *DownloadTask, j.ctrl.max)
+	// A used up quota stops only task creation, so that workers
+	// finish the tiles they have.
+	createCtx, stopCreate := context.WithCancel(ctx)
+	defer stopCreate()
+	var quotaOnce sync.Once
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err := j.createTasks(createCtx, tasks)
+		if err != nil && (ctx.Err() != nil || createCtx.Err() == nil) {
+			j.opts.logger.Error("Task creation failed", slog.Any("error", err))
+			j.addErr(ctx, err)
+			j.cancel()
+		}
+	}()
+	for i := 0; i < j.ctrl.max; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := j.solveTasks(ctx, tasks)
+			if errors.Is(err, ErrQuotaExceeded) {
+				quotaOnce.Do(func() {
+					j.opts.logger.Warn("Stopping at the quota", slog.Any("error", err))
+					j.addErr(ctx, err)
+					stopCreate()
+				})
+				return
+			}
+			if err != nil {
+				j.opts.logger.Error("Task failed", slog.Any("error", err))
+				j.addErr(ctx, err)
+				j.cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	// Tasks left after a failure are not waiting anymore.
+	for task := range tasks {
+		j.opts.metrics.queued(-1)
+		j.result(task.Tile, OUTCOME_CANCELLED, nil)
+	}
+	j.cancel()
+	j.mtx.Lock()
+	if len(j.errs) == 0 && parent.Err() != nil {
+		j.errs = append(j.errs, context.Cause(parent))
+	}
+	j.mtx.Unlock()
+	progress := j.tracker.snapshot()
+	j.opts.logger.Info("Download finished",
+		slog.Int("done", progress.Done),
+		slog.Int("skipped", progress.Skipped),
+		slog.Int("failed", progress.Failed),
+	)
+	close(j.out)
+	close(j.done)
+}
+
+// Pause stops workers from taking new tiles. Tiles being downloaded
+// are finished, the rest stay queued until Resume.
+func (j *Job) Pause() {
+	j.gate.pause()
+}
+
+// Resume continues a paused job.
+func (j *Job) Resume() {
+	j.gate.resume()
+}
+
+// Cancel stops the job, Wait returns ErrJobCancelled then.
+func (j *Job) Cancel() {
+	j.mtx.Lock()
+	select {
+	case <-j.done:
+	default:
+		j.cancelled = true
+	}
+	j.mtx.Unlock()
+	j.cancel()
+}
+
+// Done returns a channel that is closed when the job is over.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Wait blocks until the job is over and returns its errors joined,
+// failed tiles are reported as *TileError.
+func (j *Job) Wait() error {
+	<-j.done
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if j.cancelled {
+		return ErrJobCancelled
+	}
+	return j.err()
+}
+
+// Status returns the current state and progress of the job.
+func (j *Job) Status() JobStatus {
+	status := JobStatus{Progress: j.tracker.snapshot()}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	select {
+	case <-j.done:
+		switch {
+		case j.cancelled:
+			status.State = JOB_CANCELLED
+		case len(j.errs) != 0:
+			status.State = JOB_FAILED
+			status.Err = j.err()
+		default:
+			status.State = JOB_DONE
+		}
+	default:
+		switch {
+		case j.cancelled:
+			status.State = JOB_CANCELLED
+		case j.gate.paused():
+			status.State = JOB_PAUSED
+		default:
+			status.State = JOB_RUNNING
+		}
+	}
+	return status
+}
+
+// workerPool limits the workers and the bytes they hold,
+// it may be shared by several jobs.
+type workerPool struct {
+	ctrl   *aimdController
+	budget *byteBudget
+}
+
+func newWorkerPool(params DownloadParams, onChange func(active, limit int)) *workerPool {
+	return &workerPool{
+		ctrl:   newController(params, onChange),
+		budget: newByteBudget(params.MaxBytesInFlight),
+	}
+}
+
+// pauseGate is passed by workers before taking a task.
+type pauseGate struct {
+	mtx sync.Mutex
+	// resumed is not nil while paused and is closed on resume.
+	resumed chan struct{}
+}
+
+func (g *pauseGate) pause() {
+	g.mtx.Lock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+	g.mtx.Unlock()
+}
+
+func (g *pauseGate) resume() {
+	g.mtx.Lock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+	g.mtx.Unlock()
+}
+
+func (g *pauseGate) paused() bool {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.resumed != nil
+}
+
+// wait blocks while the gate is paused.
+func (g *pauseGate) wait(ctx context.Context) error {
+	g.mtx.Lock()
+	resumed := g.resumed
+	g.mtx.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-resumed:
+		return nil
+	}
+}
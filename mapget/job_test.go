@@ -0,0 +1,282 @@
+package mapget
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+// drain reads tiles from out until it is closed or nothing comes for
+// the timeout, it returns the number of read tiles and whether out
+// was closed.
+func drain(out <-chan *geography.MapTile, timeout time.Duration) (int, bool) {
+	n := 0
+	for {
+		select {
+		case _, ok := <-out:
+			if !ok {
+				return n, true
+			}
+			n++
+		case <-time.After(timeout):
+			return n, false
+		}
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	out := make(chan *geography.MapTile)
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	job := StartJob(context.Background(), params, initMapDescription(), out, newTestLoader(0, 0))
+	job.Pause()
+	// Workers finish the tiles they have taken before the pause.
+	paused, closed := drain(out, 100*time.Millisecond)
+	if closed {
+		t.Fatalf("PauseResume: job finished while paused.")
+	}
+	if paused > GOROUTINES_NUMBER {
+		t.Errorf("PauseResume: got %d tiles while paused.", paused)
+	}
+	if state := job.Status().State; state != JOB_PAUSED {
+		t.Errorf("PauseResume: state is %s, want paused.", state)
+	}
+	job.Resume()
+	resumed, _ := drain(out, time.Minute)
+	if err := job.Wait(); err != nil {
+		t.Fatalf("PauseResume: job failed: %v.", err)
+	}
+	status := job.Status()
+	if status.State != JOB_DONE {
+		t.Errorf("PauseResume: state is %s, want done.", status.State)
+	}
+	if status.Progress.Done != paused+resumed {
+		t.Errorf("PauseResume: progress reports %d tiles, got %d.", status.Progress.Done, paused+resumed)
+	}
+}
+
+func TestJobCancel(t *testing.T) {
+	out := make(chan *geography.MapTile)
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	job := StartJob(context.Background(), params, initMapDescription(), out, newTestLoader(0, 0))
+	job.Pause()
+	job.Cancel()
+	drain(out, time.Minute)
+	if err := job.Wait(); err != ErrJobCancelled {
+		t.Errorf("JobCancel: Wait returned %v, want ErrJobCancelled.", err)
+	}
+	if state := job.Status().State; state != JOB_CANCELLED {
+		t.Errorf("JobCancel: state is %s, want cancelled.", state)
+	}
+}
+
+func TestCancelDownloads(t *testing.T) {
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	started := make(chan struct{}, GOROUTINES_NUMBER)
+	// Requests hang until the job is cancelled.
+	loader := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	failed, cancelled := 0, 0
+	results := WithResults(func(r Result) {
+		switch r.Outcome {
+		case OUTCOME_FAILED:
+			failed++
+		case OUTCOME_CANCELLED:
+			cancelled++
+		}
+	})
+	out := make(chan *geography.MapTile)
+	job := StartJob(context.Background(), params, initMapDescription(), out, loader, results)
+	<-started
+	job.Cancel()
+	drain(out, time.Minute)
+	if err := job.Wait(); err != ErrJobCancelled {
+		t.Errorf("CancelDownloads: Wait returned %v, want ErrJobCancelled.", err)
+	}
+	// Tiles stopped by the cancel are not failed.
+	if n := job.Status().Progress.Failed; n != 0 || failed != 0 || cancelled == 0 {
+		t.Errorf("CancelDownloads: progress has %d failed, results have %d failed and %d cancelled.", n, failed, cancelled)
+	}
+}
+
+func TestPauseWaitingWorker(t *testing.T) {
+	// Two workers share a slot, so the second one waits for it.
+	params := DownloadParams{
+		GoroutinesNum: 1,
+		TryTimes:      TRY_TIMES,
+		Adaptive:      true,
+		MinGoroutines: 1,
+		MaxGoroutines: 2,
+	}
+	var requests int32
+	started := make(chan struct{}, 1)
+	proceed := make(chan struct{})
+	loader := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			started <- struct{}{}
+			<-proceed
+		}
+		return ioutil.NopCloser(strings.NewReader(url)), nil
+	})
+	out := make(chan *geography.MapTile)
+	job := StartJob(context.Background(), params, initMapDescription(), out, loader)
+	<-started
+	// Let the second worker get to waiting for the slot.
+	time.Sleep(50 * time.Millisecond)
+	job.Pause()
+	close(proceed)
+	if paused, _ := drain(out, 100*time.Millisecond); paused != 1 {
+		t.Errorf("PauseWaitingWorker: got %d tiles while paused, want 1.", paused)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("PauseWaitingWorker: %d requests while paused, want 1.", n)
+	}
+	job.Resume()
+	drain(out, time.Minute)
+	if err := job.Wait(); err != nil {
+		t.Fatalf("PauseWaitingWorker: job failed: %v.", err)
+	}
+}
+
+func TestPauseIdleWorker(t *testing.T) {
+	params := DownloadParams{
+		GoroutinesNum: 1,
+		TryTimes:      TRY_TIMES,
+	}
+	var requests int32
+	loader := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		atomic.AddInt32(&requests, 1)
+		return ioutil.NopCloser(strings.NewReader(url)), nil
+	})
+	out := make(chan *geography.MapTile, 1)
+	j := newTestJob(params, loader, newWorkerPool(params, nil), out)
+	tasks := make(chan *DownloadTask)
+	solved := make(chan error, 1)
+	go func() {
+		solved <- j.solveTasks(context.Background(), tasks)
+	}()
+	// Let the worker get to waiting for a task.
+	time.Sleep(50 * time.Millisecond)
+	j.Pause()
+	tasks <- j.testTask()
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("PauseIdleWorker: %d requests while paused, want 0.", n)
+	}
+	j.Resume()
+	<-out
+	close(tasks)
+	if err := <-solved; err != nil {
+		t.Errorf("PauseIdleWorker: solveTasks failed: %v.", err)
+	}
+}
+
+// newTestJob makes a job of the workers of the pool without starting it.
+func newTestJob(params DownloadParams, loader Loader, pool *workerPool, out chan<- *geography.MapTile) *Job {
+	return &Job{
+		params:  params,
+		mapDesc: initMapDescription(),
+		out:     out,
+		client:  loader,
+		opts:    newOptions(nil),
+		tracker: &progressTracker{},
+		gate:    &pauseGate{},
+		ctrl:    pool.ctrl,
+		budget:  pool.budget,
+	}
+}
+
+// testTask returns a task of a tile of the map of the job.
+func (j *Job) testTask() *DownloadTask {
+	mapDesc := j.mapDesc
+	return &DownloadTask{
+		Tile: &geography.MapTile{
+			Z: mapDesc.MinZoom, Provider: mapDesc.Provider, Type: mapDesc.Type, Language: mapDesc.Language,
+		},
+		Scale: mapDesc.Scale,
+	}
+}
+
+func TestSharedSlots(t *testing.T) {
+	params := DownloadParams{
+		GoroutinesNum: 1,
+		TryTimes:      TRY_TIMES,
+	}
+	loader := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(url)), nil
+	})
+	pool := newWorkerPool(params, nil)
+	// The first job has no tasks yet, its worker must not hold the slot.
+	idle := newTestJob(params, loader, pool, make(chan *geography.MapTile))
+	idleTasks := make(chan *DownloadTask)
+	defer close(idleTasks)
+	go idle.solveTasks(context.Background(), idleTasks)
+	time.Sleep(50 * time.Millisecond)
+	out := make(chan *geography.MapTile, 1)
+	busy := newTestJob(params, loader, pool, out)
+	tasks := make(chan *DownloadTask, 1)
+	tasks <- busy.testTask()
+	close(tasks)
+	go busy.solveTasks(context.Background(), tasks)
+	select {
+	case <-out:
+	case <-time.After(time.Second):
+		t.Errorf("SharedSlots: a job waiting for tasks holds the slot.")
+	}
+}
+
+func TestRetryAfterSlot(t *testing.T) {
+	// Two workers share a slot.
+	params := DownloadParams{
+		GoroutinesNum: 1,
+		TryTimes:      2,
+		Adaptive:      true,
+		MinGoroutines: 1,
+		MaxGoroutines: 2,
+	}
+	var requests int32
+	// The first request is throttled, the slot is left to the next tile
+	// during the wait.
+	loader := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			return nil, &HTTPError{URL: url, StatusCode: http.StatusTooManyRequests, RetryAfter: time.Second}
+		}
+		return ioutil.NopCloser(strings.NewReader(url)), nil
+	})
+	mapDesc := initMapDescription()
+	mapDesc.Tiles = []geography.TileNum{{Z: 10, X: 1, Y: 1}, {Z: 10, X: 2, Y: 2}}
+	start := time.Now()
+	it := Download(context.Background(), mapDesc, params, WithLoader(loader))
+	var first time.Duration
+	tiles := 0
+	for it.Next() {
+		if tiles == 0 {
+			first = time.Since(start)
+		}
+		tiles++
+	}
+	if err := it.Err(); err != nil || tiles != 2 {
+		t.Fatalf("RetryAfterSlot: got %d tiles, %v.", tiles, err)
+	}
+	if first >= time.Second {
+		t.Errorf("RetryAfterSlot: the first tile took %v, the slot was held while waiting.", first)
+	}
+}
@@ -0,0 +1,194 @@
+package mapget
+
+// journal.go: append-only record of a job, so that it can be resumed
+// after the process is killed.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type TileState int
+
+const (
+	TILE_DOWNLOADED TileState = iota + 1
+	TILE_VERIFIED
+	TILE_STORED
+)
+
+// JobDefinition is everything needed to restart a job.
+type JobDefinition struct {
+	ID      string         `json:"id"`
+	MapDesc MapDescription `json:"map_description"`
+	Params  DownloadParams `json:"download_params"`
+	// Path is where the tiles are stored, if the job
+	// writes them to a directory.
+	Path    string    `json:"path,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type tileKey struct {
+	Z int `json:"z"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// journalRecord is a single line of the journal. The first line
+// holds the job, the rest are tile state changes.
+type journalRecord struct {
+	Job   *JobDefinition `json:"job,omitempty"`
+	Tile  *tileKey       `json:"tile,omitempty"`
+	State TileState      `json:"state,omitempty"`
+}
+
+// Journal is an append-only file of a job. Every record is written
+// with a single write, a record torn by a crash is dropped on open.
+type Journal struct {
+	mtx   sync.Mutex
+	file  *os.File
+	def   JobDefinition
+	tiles map[tileKey]TileState
+}
+
+// CreateJournal creates the journal of a new job at path.
+func CreateJournal(path string, def JobDefinition) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		file:  file,
+		def:   def,
+		tiles: make(map[tileKey]TileState),
+	}
+	if err := j.write(journalRecord{Job: &def}); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// OpenJournal opens the journal of an existing job for appending.
+func OpenJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &Journal{
+		file:  file,
+		tiles: make(map[tileKey]TileState),
+	}
+	size, err := j.load()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("journal %s: %v", path, err)
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// load reads the journal and returns the size of its valid part.
+func (j *Journal) load() (int64, error) {
+	reader := bufio.NewReader(j.file)
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without the newline is a torn write.
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		var rec journalRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return 0, fmt.Errorf("bad record at offset %d: %v", size, err)
+		}
+		switch {
+		case rec.Job != nil:
+			j.def = *rec.Job
+		case rec.Tile != nil:
+			if rec.State > j.tiles[*rec.Tile] {
+				j.tiles[*rec.Tile] = rec.State
+			}
+		}
+		size += int64(len(line))
+	}
+	if j.def.ID == "" {
+		return 0, errors.New("no job definition")
+	}
+	return size, nil
+}
+
+func (j *Journal) write(rec journalRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(line, '\n'))
+	return err
+}
+
+// Definition returns the job the journal belongs to.
+func (j *Journal) Definition() JobDefinition {
+	return j.def
+}
+
+// Record appends the new state of the tile.
+func (j *Journal) Record(z, x, y int, state TileState) error {
+	key := tileKey{Z: z, X: x, Y: y}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if err := j.write(journalRecord{Tile: &key, State: state}); err != nil {
+		return err
+	}
+	if state > j.tiles[key] {
+		j.tiles[key] = state
+	}
+	return nil
+}
+
+// State returns the latest recorded state of the tile,
+// zero if nothing was recorded.
+func (j *Journal) State(z, x, y int) TileState {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.tiles[tileKey{Z: z, X: x, Y: y}]
+}
+
+// Count returns the number of tiles that reached the state.
+func (j *Journal) Count(state TileState) int {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	n := 0
+	for _, s := range j.tiles {
+		if s >= state {
+			n++
+		}
+	}
+	return n
+}
+
+// Close flushes the journal to the disk and closes it.
+func (j *Journal) Close() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
@@ -0,0 +1,127 @@
+package mapget
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+func TestJournalReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "job.journal")
+	def := JobDefinition{
+		ID:      "test",
+		MapDesc: initMapDescription(),
+		Params: DownloadParams{
+			GoroutinesNum: GOROUTINES_NUMBER,
+			TryTimes:      TRY_TIMES,
+		},
+		Path: "/tmp/test",
+	}
+	journal, err := CreateJournal(path, def)
+	if err != nil {
+		t.Fatalf("Journal: CreateJournal failed: %v.", err)
+	}
+	journal.Record(14, 1, 2, TILE_DOWNLOADED)
+	journal.Record(14, 1, 2, TILE_STORED)
+	journal.Record(14, 1, 3, TILE_DOWNLOADED)
+	if err := journal.Close(); err != nil {
+		t.Fatalf("Journal: Close failed: %v.", err)
+	}
+	// Simulate a write torn by a crash.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("Journal: %v.", err)
+	}
+	file.WriteString(`{"tile":{"z":14,"x":1,"y":4},"sta`)
+	file.Close()
+
+	journal, err = OpenJournal(path)
+	if err != nil {
+		t.Fatalf("Journal: OpenJournal failed: %v.", err)
+	}
+	defer journal.Close()
+	got := journal.Definition()
+	if got.ID != def.ID || got.Path != def.Path || got.MapDesc.MaxZoom != def.MapDesc.MaxZoom {
+		t.Errorf("Journal: got definition %+v, want %+v.", got, def)
+	}
+	if state := journal.State(14, 1, 2); state != TILE_STORED {
+		t.Errorf("Journal: tile 14/1/2 is in state %d, want stored.", state)
+	}
+	if state := journal.State(14, 1, 3); state != TILE_DOWNLOADED {
+		t.Errorf("Journal: tile 14/1/3 is in state %d, want downloaded.", state)
+	}
+	if state := journal.State(14, 1, 4); state != 0 {
+		t.Errorf("Journal: torn record of tile 14/1/4 was loaded.")
+	}
+	if err := journal.Record(14, 1, 4, TILE_DOWNLOADED); err != nil {
+		t.Fatalf("Journal: Record after reopen failed: %v.", err)
+	}
+	journal.Close()
+	journal, err = OpenJournal(path)
+	if err != nil {
+		t.Fatalf("Journal: OpenJournal after torn record failed: %v.", err)
+	}
+	if state := journal.State(14, 1, 4); state != TILE_DOWNLOADED {
+		t.Errorf("Journal: tile 14/1/4 is in state %d, want downloaded.", state)
+	}
+}
+
+func TestJournalResume(t *testing.T) {
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	def := JobDefinition{ID: "test", MapDesc: initMapDescription(), Params: params}
+	journal, err := CreateJournal(filepath.Join(t.TempDir(), "job.journal"), def)
+	if err != nil {
+		t.Fatalf("JournalResume: CreateJournal failed: %v.", err)
+	}
+	defer journal.Close()
+	download := func() (int, Progress) {
+		var wg sync.WaitGroup
+		var last Progress
+		out := make(chan *geography.MapTile)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err = DownloadMap(
+				context.Background(),
+				params,
+				def.MapDesc,
+				out,
+				newTestLoader(0, 0),
+				WithJournal(journal),
+				WithProgress(func(p Progress) { last = p }),
+			)
+		}()
+		n := 0
+		for tile := range out {
+			// Store every second tile.
+			if n%2 == 0 {
+				journal.Record(tile.Z, tile.X, tile.Y, TILE_STORED)
+			}
+			n++
+		}
+		wg.Wait()
+		if err != nil {
+			t.Fatalf("JournalResume: DownloadMap failed: %v.", err)
+		}
+		return n, last
+	}
+	total, _ := download()
+	stored := journal.Count(TILE_STORED)
+	if journal.Count(TILE_DOWNLOADED) != total {
+		t.Errorf("JournalResume: journal has %d tiles, want %d.", journal.Count(TILE_DOWNLOADED), total)
+	}
+	n, last := download()
+	if n != total-stored {
+		t.Errorf("JournalResume: downloaded %d tiles on resume, want %d.", n, total-stored)
+	}
+	if last.Skipped != stored {
+		t.Errorf("JournalResume: skipped %d tiles, want %d.", last.Skipped, stored)
+	}
+}
@@ -2,13 +2,16 @@
 package mapget
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 
 	"github.com/PlaceDescriber/PlaceDescriber/geography"
@@ -26,6 +29,8 @@ const (
 	MAX_TRY_TIMES  = 20
 	MIN_GOROUTINES = 1
 	MAX_GOROUTINES = 1000
+	// MAX_RETRY_AFTER caps waits asked by Retry-After.
+	MAX_RETRY_AFTER = time.Minute
 )
 
 type MapDescription struct {
@@ -36,16 +41,185 @@ type MapDescription struct {
 	MinZoom  int           `json:"min_zoom"`
 	MaxZoom  int           `json:"max_zoom"`
 	Scale    int           `json:"scale"`
+	// Route is downloaded instead of MapArea if it is set,
+	// with Buffer metres on either side.
+	Route  *types.LineString `json:"route,omitempty"`
+	Buffer float64           `json:"buffer,omitempty"`
+	// Layers are downloaded instead of MapArea and zoom levels
+	// if they are set, tiles shared by layers are downloaded once.
+	Layers []AreaLayer `json:"layers,omitempty"`
+	// Tiles lists the tiles to download instead of MapArea
+	// and zoom levels.
+	Tiles []geography.TileNum `json:"tiles,omitempty"`
+	// Fallbacks are providers tried in order for tiles that Provider
+	// fails to serve or serves as placeholders, see WithPlaceholder,
+	// and after its quota is used up, see WithQuotas.
+	// They must have the projection and the map type of Provider.
+	Fallbacks []string `json:"fallbacks,omitempty"`
+}
+
+// AreaLayer is an area with zoom levels of its own, e.g. a country
+// at low zoom levels and its cities at high ones.
+type AreaLayer struct {
+	Name    string            `json:"name"`
+	MapArea types.Polygon     `json:"map_area"`
+	Route   *types.LineString `json:"route,omitempty"`
+	Buffer  float64           `json:"buffer,omitempty"`
+	MinZoom int               `json:"min_zoom"`
+	MaxZoom int               `json:"max_zoom"`
 }
 
 type DownloadParams struct {
 	GoroutinesNum int `json:"goroutines_num"`
 	TryTimes      int `json:"try_times"`
+	// Adaptive lets the number of active workers float between
+	// MinGoroutines and MaxGoroutines, starting from GoroutinesNum.
+	Adaptive      bool `json:"adaptive"`
+	MinGoroutines int  `json:"min_goroutines"`
+	MaxGoroutines int  `json:"max_goroutines"`
+	// MaxBytesInFlight caps the size of tiles held by workers,
+	// zero means no cap.
+	MaxBytesInFlight int64 `json:"max_bytes_in_flight"`
+	// AttemptTimeout limits a single request of a tile, TileTimeout
+	// all attempts of a tile and JobTimeout the whole job. Zero
+	// means no limit.
+	AttemptTimeout time.Duration `json:"attempt_timeout"`
+	TileTimeout    time.Duration `json:"tile_timeout"`
+	JobTimeout     time.Duration `json:"job_timeout"`
+	// Shards splits tiles into disjoint shards for several processes,
+	// the job downloads only the tiles of Shard, from 0 to Shards-1.
+	// Zero Shards means all tiles.
+	Shard  int `json:"shard"`
+	Shards int `json:"shards"`
+}
+
+// ShardOf returns the shard of the tile among n shards. Shards depend
+// only on z/x/y, so they are the same in every process. With n below 1
+// all tiles are in shard 0.
+func ShardOf(z, x, y, n int) int {
+	if n < 1 {
+		return 0
+	}
+	hash := fnv.New32a()
+	fmt.Fprintf(hash, "%d/%d/%d", z, x, y)
+	return int(hash.Sum32() % uint32(n))
+}
+
+// Errors of timeouts set in DownloadParams.
+var (
+	ErrAttemptTimeout = errors.New("attempt timed out")
+	ErrTileTimeout    = errors.New("tile timed out")
+	ErrJobTimeout     = errors.New("job timed out")
+)
+
+// withTimeout returns ctx limited by the timeout with the cause,
+// ctx itself if the timeout is zero.
+func withTimeout(ctx context.Context, timeout time.Duration, cause error) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, timeout, cause)
+}
+
+// Progress is a snapshot of a running download. Failed doesn't count
+// tiles left undone by a stopped job.
+type Progress struct {
+	Done          int `json:"done"`
+	Skipped       int `json:"skipped"`
+	Failed        int `json:"failed"`
+	Retries       int `json:"retries"`
+	ActiveWorkers int `json:"active_workers"`
+	WorkerLimit   int `json:"worker_limit"`
+	// Layers is the progress of layers of MapDescription in their
+	// order, a tile shared by layers counts in each of them.
+	Layers []LayerProgress `json:"layers,omitempty"`
+}
+
+// LayerProgress is the progress of a layer of MapDescription.
+type LayerProgress struct {
+	Name    string `json:"name"`
+	Total   int    `json:"total"`
+	Done    int    `json:"done"`
+	Skipped int    `json:"skipped"`
+	Failed  int    `json:"failed"`
+}
+
+// clone returns the copy of the progress which shares nothing with it.
+func (p Progress) clone() Progress {
+	p.Layers = append([]LayerProgress(nil), p.Layers...)
+	return p
+}
+
+// Option configures optional behaviour of DownloadMap.
+type Option func(*options)
+
+type options struct {
+	progress      func(Progress)
+	entryProgress func(entry int, p Progress)
+	results       func(Result)
+	journal       *Journal
+	metrics       *Metrics
+	logger        *slog.Logger
+	store         Store
+	loader        Loader
+	quotas        *Quotas
+	cache         *DiskCache
+	placeholder   func(*geography.MapTile) bool
+	registry      *Registry
+}
+
+// WithProgress makes DownloadMap call f every time the progress changes.
+// Calls are serialized.
+func WithProgress(f func(Progress)) Option {
+	return func(o *options) {
+		o.progress = f
+	}
+}
+
+// WithJournal records downloaded tiles in the journal and skips
+// the tiles it has as stored.
+func WithJournal(j *Journal) Option {
+	return func(o *options) {
+		o.journal = j
+	}
+}
+
+// WithLogger makes DownloadMap log to logger, it is silent by default
+// and with nil logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithPlaceholder makes the job try fallback providers of the map for
+// tiles that f reports as placeholders, e.g. "no imagery" images.
+// Tiles written to the store with WithStore have no content to check.
+func WithPlaceholder(f func(tile *geography.MapTile) bool) Option {
+	return func(o *options) {
+		o.placeholder = f
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.logger == nil {
+		o.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+	if o.registry == nil {
+		o.registry = NewRegistry(MapProjects)
+	}
+	return o
 }
 
 type DownloadTask struct {
 	Tile  *geography.MapTile `json:"tile"`
 	Scale int                `json:"scale"`
+	// layers are indices of layers of the map having the tile.
+	layers []int
 }
 
 type Loader interface {
@@ -53,6 +227,55 @@ type Loader interface {
 }
 
 type DefaultLoader struct {
+	// Client is used for requests, a client with
+	// default settings if nil.
+	Client *http.Client
+}
+
+// HTTPError is returned by DefaultLoader for unsuccessful responses.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	// RetryAfter is how long the server asked to wait
+	// before the next request.
+	RetryAfter time.Duration
+}
+
+// parseRetryAfter parses Retry-After header given in seconds or as a date.
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d", e.URL, e.StatusCode)
+}
+
+// TileError is returned for tiles that failed all attempts.
+type TileError struct {
+	Z        int
+	X        int
+	Y        int
+	Provider string
+	// URL, StatusCode and Err are of the last attempt,
+	// StatusCode is zero if there was no HTTP response.
+	URL        string
+	Attempts   int
+	StatusCode int
+	Err        error
+}
+
+func (e *TileError) Error() string {
+	return fmt.Sprintf("tile %d/%d/%d of %s failed after %d attempts: %v", e.Z, e.X, e.Y, e.Provider, e.Attempts, e.Err)
+}
+
+func (e *TileError) Unwrap() error {
+	return e.Err
 }
 
 func prepareHeader(header *http.Header) {
@@ -66,16 +289,30 @@ func prepareHeader(header *http.Header) {
 }
 
 func (s DefaultLoader) Do(ctx context.Context, url string) (io.ReadCloser, error) {
-	client := &http.Client{}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{}
+	}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
 	prepareHeader(&req.Header)
+	for key, values := range HeaderFromContext(ctx) {
+		req.Header[key] = values
+	}
 	res, err := ctxhttp.Do(ctx, client, req)
 	if err != nil {
 		return nil, err
 	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, &HTTPError{
+			URL:        url,
+			StatusCode: res.StatusCode,
+			RetryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+		}
+	}
 	return res.Body, nil
 }
 
@@ -93,14 +330,38 @@ func max(x, y int) int {
 	return y
 }
 
-func checkInput(mapDesc MapDescription, params DownloadParams) error {
+func checkParams(params DownloadParams) error {
 	if params.TryTimes < MIN_TRY_TIMES || params.TryTimes > MAX_TRY_TIMES {
 		return fmt.Errorf("TryTimes is out of range: %d", params.TryTimes)
 	}
 	if params.GoroutinesNum < MIN_GOROUTINES || params.GoroutinesNum > MAX_GOROUTINES {
 		return fmt.Errorf("GoroutinesNum is out of range: %d", params.GoroutinesNum)
 	}
-	_, ok := MapProjects[mapDesc.Provider]
+	if params.MaxBytesInFlight < 0 {
+		return fmt.Errorf("MaxBytesInFlight is negative: %d", params.MaxBytesInFlight)
+	}
+	if params.Shards < 0 || params.Shard < 0 || params.Shard >= max(params.Shards, 1) {
+		return fmt.Errorf("Shard %d of %d is out of range", params.Shard, params.Shards)
+	}
+	if params.AttemptTimeout < 0 || params.TileTimeout < 0 || params.JobTimeout < 0 {
+		return fmt.Errorf("Timeouts are negative: %v, %v, %v", params.AttemptTimeout, params.TileTimeout, params.JobTimeout)
+	}
+	if params.Adaptive {
+		if params.MinGoroutines < MIN_GOROUTINES || params.MaxGoroutines > MAX_GOROUTINES {
+			return fmt.Errorf("Goroutines limits are out of range: %d-%d", params.MinGoroutines, params.MaxGoroutines)
+		}
+		if params.GoroutinesNum < params.MinGoroutines || params.GoroutinesNum > params.MaxGoroutines {
+			return fmt.Errorf("GoroutinesNum %d is not within %d-%d", params.GoroutinesNum, params.MinGoroutines, params.MaxGoroutines)
+		}
+	}
+	return nil
+}
+
+func checkInput(mapDesc MapDescription, params DownloadParams, registry *Registry) error {
+	if err := checkParams(params); err != nil {
+		return err
+	}
+	mapProj, ok := registry.Lookup(mapDesc.Provider)
 	if !ok {
 		return fmt.Errorf("Bad map provider %s", mapDesc.Provider)
 	}
@@ -108,186 +369,506 @@ func checkInput(mapDesc MapDescription, params DownloadParams) error {
 	if !ok {
 		return fmt.Errorf("Bad map type %s", typeStr)
 	}
+	for _, fallback := range mapDesc.Fallbacks {
+		if err := checkFallback(mapDesc, mapProj, fallback, registry); err != nil {
+			return err
+		}
+	}
 	// TODO: check language here.
+	if mapDesc.Scale < MIN_SCALE || mapDesc.Scale > MAX_SCALE {
+		return fmt.Errorf("Scale is out of range: %d", mapDesc.Scale)
+	}
+	if len(mapDesc.Tiles) != 0 {
+		for _, tile := range mapDesc.Tiles {
+			if tile.Z < MIN_ZOOM || tile.Z > MAX_ZOOM {
+				return fmt.Errorf("Zoom of tile %s is out of range", tile)
+			}
+			if n := 1 << uint(tile.Z); tile.X < 0 || tile.X >= n || tile.Y < 0 || tile.Y >= n {
+				return fmt.Errorf("Tile %s is out of range", tile)
+			}
+		}
+		return nil
+	}
+	if len(mapDesc.Layers) != 0 {
+		for _, layer := range mapDesc.Layers {
+			if err := checkLayer(layer); err != nil {
+				return fmt.Errorf("Layer %q: %v", layer.Name, err)
+			}
+		}
+		return nil
+	}
 	if mapDesc.MinZoom < MIN_ZOOM || mapDesc.MinZoom > MAX_ZOOM {
 		return fmt.Errorf("MinZoom is out of range: %d", mapDesc.MinZoom)
 	}
 	if mapDesc.MaxZoom < MIN_ZOOM || mapDesc.MaxZoom > MAX_ZOOM {
 		return fmt.Errorf("MaxZoom is out of range: %d", mapDesc.MaxZoom)
 	}
-	if mapDesc.Scale < MIN_SCALE || mapDesc.Scale > MAX_SCALE {
-		return fmt.Errorf("Scale is out of range: %d", mapDesc.Scale)
-	}
 	if mapDesc.MinZoom >= mapDesc.MaxZoom {
 		return fmt.Errorf("MinZoom is greater or equal to MaxZoom")
 	}
+	if mapDesc.Buffer < 0 {
+		return fmt.Errorf("Buffer is negative: %v", mapDesc.Buffer)
+	}
 	return nil
 }
 
-func extremeTileNumbers(
-	z int,
-	mapArea types.Polygon,
-	converter geography.Conversion,
-) (int, int, int, int, error) {
-	minLat, minLong, maxLat, maxLong, err := mapArea.ExtremeCoordinates()
-	x0, y0 := converter.DegToTileNum(types.Point{minLat, minLong}, z)
-	x1, y1 := converter.DegToTileNum(types.Point{maxLat, maxLong}, z)
-	return min(x0, x1), max(x0, x1), min(y0, y1), max(y0, y1), err
+// checkFallback checks that the fallback provider has the projection
+// of the map provider and supports the map type.
+func checkFallback(mapDesc MapDescription, primary MapProject, fallback string, registry *Registry) error {
+	mapProj, ok := registry.Lookup(fallback)
+	if !ok {
+		return fmt.Errorf("Bad fallback provider %s", fallback)
+	}
+	if mapProj.Converter() != primary.Converter() {
+		return fmt.Errorf("Fallback provider %s has another projection than %s", fallback, mapDesc.Provider)
+	}
+	if _, ok := mapProj.(RequestProject); ok {
+		// Its URLs may take requests, e.g. to a plugin.
+		if _, ok := types.MapTypeToStr[mapDesc.Type]; !ok {
+			return fmt.Errorf("Fallback provider %s doesn't support map type %d", fallback, mapDesc.Type)
+		}
+		return nil
+	}
+	if _, err := mapProj.GetURL(0, 0, 0, mapDesc.Scale, mapDesc.Language, mapDesc.Type); err != nil {
+		return fmt.Errorf("Fallback provider %s doesn't fit: %v", fallback, err)
+	}
+	return nil
 }
 
-func downloadTile(
-	ctx context.Context,
-	task *DownloadTask,
-	client Loader,
-) (*geography.MapTile, error) {
+func checkLayer(layer AreaLayer) error {
+	if layer.MinZoom < MIN_ZOOM || layer.MaxZoom > MAX_ZOOM {
+		return fmt.Errorf("Zoom levels are out of range: %d-%d", layer.MinZoom, layer.MaxZoom)
+	}
+	if layer.MinZoom > layer.MaxZoom {
+		return fmt.Errorf("MinZoom is greater than MaxZoom")
+	}
+	if layer.Buffer < 0 {
+		return fmt.Errorf("Buffer is negative: %v", layer.Buffer)
+	}
+	return nil
+}
+
+// attempt describes a successful download attempt.
+type attempt struct {
+	url     string
+	size    int64
+	outcome Outcome
+}
+
+// downloadTile downloads the tile within AttemptTimeout to its Content
+// or to the store. Content stays held in the byte budget until it is released.
+// The URL is returned with failures as well.
+func (j *Job) downloadTile(ctx context.Context, task *DownloadTask) (*geography.MapTile, attempt, error) {
 	tile := task.Tile
-	mapProj, ok := MapProjects[tile.Provider]
+	mapProj, ok := j.opts.registry.Lookup(tile.Provider)
 	if !ok {
-		return nil, fmt.Errorf("downloadTile: bad map provider %s", tile.Provider)
+		return nil, attempt{}, fmt.Errorf("downloadTile: bad map provider %s", tile.Provider)
+	}
+	attemptCtx, cancel := withTimeout(ctx, j.params.AttemptTimeout, ErrAttemptTimeout)
+	defer cancel()
+	attemptCtx = WithProvider(attemptCtx, tile.Provider)
+	var url string
+	var err error
+	if reqProj, ok := mapProj.(RequestProject); ok {
+		var header http.Header
+		url, header, err = reqProj.GetRequest(attemptCtx, tile.X, tile.Y, tile.Z, task.Scale, tile.Language, tile.Type)
+		attemptCtx = WithHeader(attemptCtx, header)
+	} else {
+		url, err = mapProj.GetURL(tile.X, tile.Y, tile.Z, task.Scale, tile.Language, tile.Type)
 	}
-	url, err := mapProj.GetURL(tile.X, tile.Y, tile.Z, task.Scale, tile.Language, tile.Type)
 	if err != nil {
-		return nil, err
+		return nil, attempt{}, err
+	}
+	tile, a, err := j.fetchTile(attemptCtx, tile, url)
+	// Tell timeouts of the attempt from the ones of the tile and the job.
+	if err != nil && attemptCtx.Err() != nil && ctx.Err() == nil {
+		err = context.Cause(attemptCtx)
+	}
+	return tile, a, err
+}
+
+// fetchTile requests the tile from url.
+func (j *Job) fetchTile(ctx context.Context, tile *geography.MapTile, url string) (*geography.MapTile, attempt, error) {
+	client := j.client
+	if cacheOnly(ctx) {
+		client = j.opts.cache.offlineLoader()
 	}
 	body, err := client.Do(ctx, url)
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusNoContent {
+		return tile, attempt{url: url, outcome: OUTCOME_EMPTY}, nil
+	}
 	if err != nil {
-		return nil, err
+		return nil, attempt{url: url}, err
 	}
 	defer body.Close()
-	tile.Content, err = ioutil.ReadAll(body)
+	a := attempt{url: url, outcome: OUTCOME_DOWNLOADED}
+	if cacheHit(ctx) {
+		a.outcome = OUTCOME_CACHED
+	}
+	reader := &budgetReader{
+		ctx:    ctx,
+		r:      body,
+		budget: j.budget,
+		keep:   j.opts.store == nil,
+	}
+	if j.opts.store != nil {
+		// Look ahead, so that empty tiles are not stored.
+		content := bufio.NewReader(reader)
+		if _, err = content.Peek(1); err == io.EOF {
+			reader.close()
+			a.outcome = OUTCOME_EMPTY
+			return tile, a, nil
+		}
+		if err == nil {
+			err = j.opts.store.Put(ctx, tile, content)
+		}
+		reader.close()
+	} else {
+		tile.Content, err = ioutil.ReadAll(reader)
+	}
 	if err != nil {
-		return nil, err
+		reader.close()
+		return nil, attempt{url: url}, err
 	}
-	return tile, nil
+	a.size = reader.read
+	if a.size == 0 {
+		a.outcome = OUTCOME_EMPTY
+	}
+	return tile, a, nil
 }
 
-func downloadTileWrapper(
-	ctx context.Context,
-	tryTimes int,
-	task *DownloadTask,
-	client Loader,
-) (*geography.MapTile, error) {
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// downloadTileWrapper downloads the tile from the provider of the map
+// or from its fallbacks if the provider fails, serves a placeholder
+// or has its quota used up.
+func (j *Job) downloadTileWrapper(ctx context.Context, task *DownloadTask) (*geography.MapTile, Outcome, error) {
+	jobCtx := ctx
+	ctx, cancel := withTimeout(ctx, j.params.TileTimeout, ErrTileTimeout)
+	defer cancel()
+	providers := append([]string{task.Tile.Provider}, j.mapDesc.Fallbacks...)
+	var placeholder *geography.MapTile
+	var placeholderOutcome Outcome
+	var tileErr, quotaErr error
+	for i, provider := range providers {
+		if i > 0 {
+			j.opts.logger.LogAttrs(ctx, slog.LevelInfo, "Falling back to another provider",
+				tileAttrs(task.Tile),
+				slog.String("fallback", provider),
+			)
+		}
+		tile := *task.Tile
+		tile.Provider = provider
+		fallbackTask := &DownloadTask{Tile: &tile, Scale: task.Scale}
+		downloaded, outcome, err := j.downloadFrom(jobCtx, ctx, fallbackTask)
+		if err == nil {
+			if j.opts.placeholder == nil || outcome == OUTCOME_EMPTY || !j.opts.placeholder(downloaded) {
+				return downloaded, outcome, nil
+			}
+			// Keep the first placeholder in case no provider has the tile.
+			// Its bytes are released meanwhile, fallbacks could wait
+			// for them forever.
+			j.budget.release(int64(len(downloaded.Content)))
+			if placeholder == nil {
+				placeholder, placeholderOutcome = downloaded, outcome
+			}
+			continue
+		}
+		if errors.Is(err, ErrQuotaExceeded) {
+			quotaErr = err
+			continue
+		}
+		var failed *TileError
+		if !errors.As(err, &failed) || ctx.Err() != nil {
+			return nil, OUTCOME_FAILED, err
+		}
+		tileErr = err
+	}
+	if placeholder != nil {
+		if err := j.budget.acquire(jobCtx, int64(len(placeholder.Content))); err != nil {
+			return nil, OUTCOME_FAILED, err
+		}
+		return placeholder, placeholderOutcome, nil
+	}
+	if tileErr == nil {
+		// The quotas of all providers are used up.
+		return nil, OUTCOME_FAILED, quotaErr
+	}
+	return nil, OUTCOME_FAILED, tileErr
+}
+
+// downloadFrom downloads the tile from the provider of the task
+// in the tile context ctx of the job context jobCtx.
+func (j *Job) downloadFrom(jobCtx, ctx context.Context, task *DownloadTask) (*geography.MapTile, Outcome, error) {
+	tryTimes := j.params.TryTimes
+	provider := task.Tile.Provider
+	tileErr := &TileError{
+		Z:        task.Tile.Z,
+		X:        task.Tile.X,
+		Y:        task.Tile.Y,
+		Provider: provider,
+	}
 	for i := 0; i < tryTimes; i++ {
-		tile, err := downloadTile(ctx, task, client)
+		if i > 0 {
+			j.tracker.retry()
+			j.opts.metrics.retry(provider)
+		}
+		state := &cacheState{}
+		var quotaErr error
+		if err := j.opts.quotas.take(provider); err != nil {
+			if !errors.Is(err, ErrQuotaExceeded) || j.opts.cache == nil {
+				return nil, OUTCOME_FAILED, err
+			}
+			// The tile may still be in the cache.
+			state.only, quotaErr = true, err
+		}
+		start := time.Now()
+		tile, a, err := j.downloadTile(withCacheState(ctx, state), task)
+		if state.only && errors.Is(err, ErrCacheMiss) {
+			return nil, OUTCOME_FAILED, quotaErr
+		}
+		if err == nil && a.outcome == OUTCOME_CACHED && !state.only {
+			j.opts.quotas.refund(provider)
+		}
+		latency := time.Since(start)
+		j.ctrl.observe(ctx, latency, err)
+		j.opts.metrics.request(provider, latency, err)
 		if err == nil {
-			return tile, nil
+			j.opts.metrics.tile(provider, tile.Z, a.size)
+			return tile, a.outcome, nil
+		}
+		if jobCtx.Err() != nil && errors.Is(err, jobCtx.Err()) {
+			return nil, OUTCOME_FAILED, err
+		}
+		if ctx.Err() != nil && jobCtx.Err() == nil {
+			tileErr.URL, tileErr.Attempts, tileErr.Err = a.url, i+1, context.Cause(ctx)
+			break
+		}
+		j.opts.logger.LogAttrs(ctx, slog.LevelWarn, "Tile download attempt failed",
+			tileAttrs(task.Tile),
+			slog.Int("attempt", i+1),
+			slog.String("url", a.url),
+			slog.Any("error", err),
+		)
+		tileErr.URL, tileErr.Attempts, tileErr.StatusCode, tileErr.Err = a.url, i+1, 0, err
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) {
+			tileErr.StatusCode = httpErr.StatusCode
+			if httpErr.RetryAfter > 0 && i+1 < tryTimes {
+				delay := httpErr.RetryAfter
+				if delay > MAX_RETRY_AFTER {
+					delay = MAX_RETRY_AFTER
+				}
+				if err := j.waitRetry(ctx, delay); err != nil {
+					if jobCtx.Err() != nil {
+						return nil, OUTCOME_FAILED, err
+					}
+					tileErr.Err = context.Cause(ctx)
+					break
+				}
+			}
 		}
-		log.Printf("downloadTile failed with %v", err)
 	}
-	err := fmt.Errorf("downloadTileWrapper: tried %d times and failed", tryTimes)
-	log.Printf("%v", err)
-	return nil, err
+	j.opts.logger.LogAttrs(ctx, slog.LevelError, "Tile download failed",
+		tileAttrs(task.Tile),
+		slog.Int("attempts", tileErr.Attempts),
+		slog.Any("error", tileErr.Err),
+	)
+	return nil, OUTCOME_FAILED, tileErr
 }
 
-func solveTasks(
-	ctx context.Context,
-	tryTimes int,
-	tasks <-chan *DownloadTask,
-	out chan<- *geography.MapTile,
-	client Loader,
-) error {
-	for task := range tasks {
-		tile, err := downloadTileWrapper(ctx, tryTimes, task, client)
+// tileAttrs groups the fields identifying the tile in logs.
+func tileAttrs(tile *geography.MapTile) slog.Attr {
+	return slog.Group("tile",
+		slog.String("provider", tile.Provider),
+		slog.Int("z", tile.Z),
+		slog.Int("x", tile.X),
+		slog.Int("y", tile.Y),
+	)
+}
+
+// waitRetry sleeps for d before the next attempt, leaving the slot
+// of the worker to others meanwhile.
+func (j *Job) waitRetry(ctx context.Context, d time.Duration) error {
+	j.ctrl.release()
+	err := sleep(ctx, d)
+	if err == nil {
+		err = j.takeSlot(ctx)
+	}
+	if err != nil {
+		// The worker releases the slot when it gives up the tile.
+		j.ctrl.hold()
+	}
+	return err
+}
+
+// takeSlot waits until the job is not paused and takes a slot.
+func (j *Job) takeSlot(ctx context.Context) error {
+	for {
+		if err := j.gate.wait(ctx); err != nil {
+			return err
+		}
+		if err := j.ctrl.acquire(ctx); err != nil {
+			return err
+		}
+		// The job may have been paused while waiting for the slot.
+		if !j.gate.paused() {
+			return nil
+		}
+		j.ctrl.release()
+	}
+}
+
+func (j *Job) solveTasks(ctx context.Context, tasks <-chan *DownloadTask) error {
+	for {
+		if err := j.gate.wait(ctx); err != nil {
+			return err
+		}
+		task, ok := <-tasks
+		if !ok {
+			return nil
+		}
+		j.opts.metrics.queued(-1)
+		// Take a slot only with a task, slots of a batch are shared
+		// and jobs waiting for their tasks would hold them.
+		if err := j.takeSlot(ctx); err != nil {
+			j.result(task.Tile, OUTCOME_CANCELLED, nil)
+			return err
+		}
+		tile, outcome, err := j.downloadTileWrapper(ctx, task)
+		j.ctrl.release()
 		if err != nil {
+			var tileErr *TileError
+			if !errors.As(err, &tileErr) {
+				// The job is stopping, the tile is left undone
+				// and isn't counted as failed.
+				j.result(task.Tile, OUTCOME_CANCELLED, nil)
+				return err
+			}
+			j.tracker.fail(task.layers)
+			j.result(task.Tile, OUTCOME_FAILED, err)
 			return err
 		}
+		if outcome == OUTCOME_EMPTY {
+			j.tracker.done(task.layers)
+			j.result(tile, outcome, nil)
+			// There is nothing to store, don't ask for it again.
+			if err := j.record(tile, TILE_STORED); err != nil {
+				return err
+			}
+			continue
+		}
 		select {
 		case <-ctx.Done():
+			j.budget.release(int64(len(tile.Content)))
+			j.result(tile, OUTCOME_CANCELLED, nil)
 			return ctx.Err()
-		case out <- tile:
+		case j.out <- tile:
+			j.budget.release(int64(len(tile.Content)))
+			j.tracker.done(task.layers)
+		}
+		j.result(tile, outcome, nil)
+		state := TILE_DOWNLOADED
+		if j.opts.store != nil {
+			state = TILE_STORED
+		}
+		if err := j.record(tile, state); err != nil {
+			return err
 		}
 	}
+}
+
+// record records the tile state in the journal if any.
+func (j *Job) record(tile *geography.MapTile, state TileState) error {
+	if journal := j.opts.journal; journal != nil {
+		return journal.Record(tile.Z, tile.X, tile.Y, state)
+	}
 	return nil
 }
 
-func createTasks(
-	ctx context.Context,
-	mapDesc MapDescription,
-	tasks chan<- *DownloadTask,
-) error {
-	for z := mapDesc.MinZoom; z <= mapDesc.MaxZoom; z++ {
-		mapProj, ok := MapProjects[mapDesc.Provider]
-		if !ok {
-			close(tasks)
-			return fmt.Errorf("createTasks: bad map provider %s", mapDesc.Provider)
-		}
-		minX, maxX, minY, maxY, err := extremeTileNumbers(z, mapDesc.MapArea, mapProj.Converter())
+// skip reports whether the tile is already done.
+func (j *Job) skip(z, x, y int) bool {
+	journal := j.opts.journal
+	return journal != nil && journal.State(z, x, y) >= TILE_STORED
+}
+
+func (j *Job) createTasks(ctx context.Context, tasks chan<- *DownloadTask) error {
+	defer close(tasks)
+	mapDesc := j.mapDesc
+	tiles, err := newJobTiles(mapDesc, j.params, j.opts.registry)
+	if err != nil {
+		return err
+	}
+	if len(mapDesc.Layers) != 0 {
+		totals, err := tiles.totals()
 		if err != nil {
-			close(tasks)
 			return err
 		}
-		for x := minX; x <= maxX; x++ {
-			for y := minY; y <= maxY; y++ {
-				tile := &geography.MapTile{
-					Z:        z,
-					Y:        y,
-					X:        x,
-					Time:     time.Now(),
-					Provider: mapDesc.Provider,
-					Type:     mapDesc.Type,
-					Language: mapDesc.Language,
-				}
-				task := &DownloadTask{
-					Tile:  tile,
-					Scale: mapDesc.Scale,
-				}
-				select {
-				case <-ctx.Done():
-					close(tasks)
-					return ctx.Err()
-				case tasks <- task:
-				}
-			}
+		j.tracker.setLayers(mapDesc.Layers, totals)
+	}
+	var stopErr error
+	err = tiles.each(func(num geography.TileNum, layers []int) bool {
+		tile := &geography.MapTile{
+			Z:        num.Z,
+			Y:        num.Y,
+			X:        num.X,
+			Time:     time.Now(),
+			Provider: mapDesc.Provider,
+			Type:     mapDesc.Type,
+			Language: mapDesc.Language,
+		}
+		if j.skip(num.Z, num.X, num.Y) {
+			j.tracker.skip(layers)
+			j.result(tile, OUTCOME_UNCHANGED, nil)
+			return true
+		}
+		if stopErr != nil {
+			j.result(tile, OUTCOME_CANCELLED, nil)
+			return true
 		}
+		task := &DownloadTask{
+			Tile:   tile,
+			Scale:  mapDesc.Scale,
+			layers: layers,
+		}
+		j.opts.metrics.queued(1)
+		select {
+		case <-ctx.Done():
+			j.opts.metrics.queued(-1)
+			stopErr = ctx.Err()
+			j.result(tile, OUTCOME_CANCELLED, nil)
+			// Go on only to report the rest of tiles as cancelled.
+			return j.opts.results != nil
+		case tasks <- task:
+			return true
+		}
+	})
+	if err != nil {
+		return err
 	}
-	close(tasks)
-	return nil
+	return stopErr
 }
 
+// DownloadMap downloads the map and sends its tiles to out,
+// out is closed when the download is over.
 func DownloadMap(
 	ctx context.Context,
 	params DownloadParams,
 	mapDesc MapDescription,
 	out chan<- *geography.MapTile,
 	client Loader,
+	opts ...Option,
 ) error {
-	err := checkInput(mapDesc, params)
-	if err != nil {
-		close(out)
-		log.Printf("Incorrect input: %v.\n", err)
-		return err
-	}
-	ctx, cancel := context.WithCancel(ctx)
-	var wg sync.WaitGroup
-	var mtx sync.Mutex
-	tasks := make(chan *DownloadTask)
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err1 := createTasks(ctx, mapDesc, tasks)
-		if err1 != nil {
-			log.Printf("Task creation failed with %v.\n", err1)
-			cancel()
-			mtx.Lock()
-			err = err1
-			mtx.Unlock()
-		}
-	}()
-	for i := 0; i < params.GoroutinesNum; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			err1 := solveTasks(ctx, params.TryTimes, tasks, out, client)
-			if err1 != nil {
-				log.Printf("Task failed with %v.\n", err1)
-				mtx.Lock()
-				err = err1
-				mtx.Unlock()
-				cancel()
-			}
-		}()
-	}
-	wg.Wait()
-	close(out)
-	return err
+	return StartJob(ctx, params, mapDesc, out, client, opts...).Wait()
 }
@@ -3,12 +3,18 @@ package mapget
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"image/png"
 	"io"
 	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/PlaceDescriber/PlaceDescriber/geography"
 	"github.com/PlaceDescriber/PlaceDescriber/types"
@@ -271,3 +277,499 @@ func TestContent(t *testing.T) {
 		t.Errorf("ContentTest: DownloadMap failed: %v.", err)
 	}
 }
+
+func TestLogger(t *testing.T) {
+	var wg sync.WaitGroup
+	var err error
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	out := make(chan *geography.MapTile)
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = DownloadMap(
+			context.Background(),
+			params,
+			initMapDescription(),
+			out,
+			newTestLoader(1, 1),
+			WithLogger(logger),
+		)
+	}()
+	for _ = range out {
+	}
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Logger: DownloadMap failed: %v.", err)
+	}
+	var record struct {
+		Level   string `json:"level"`
+		Attempt int    `json:"attempt"`
+		URL     string `json:"url"`
+		Tile    struct {
+			Provider string `json:"provider"`
+			Z        int    `json:"z"`
+		} `json:"tile"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Logger: want a single record, got %q: %v.", buf.String(), err)
+	}
+	if record.Level != "WARN" || record.Attempt != 1 || record.URL == "" {
+		t.Errorf("Logger: bad record of failed attempt %q.", buf.String())
+	}
+	if record.Tile.Provider != "yandex" || record.Tile.Z < 14 {
+		t.Errorf("Logger: bad tile in record %q.", buf.String())
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	it := Download(context.Background(), initMapDescription(), params, WithLoader(newTestLoader(1, 1)), WithLogger(nil))
+	for it.Next() {
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("NilLogger: download failed: %v.", err)
+	}
+}
+
+func TestTileErrors(t *testing.T) {
+	// Both workers fail their first tiles at the same time.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var mtx sync.Mutex
+	calls := 0
+	loader := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		mtx.Lock()
+		calls++
+		first := calls <= 2
+		mtx.Unlock()
+		if first {
+			wg.Done()
+			wg.Wait()
+		}
+		return nil, &HTTPError{URL: url, StatusCode: 503}
+	})
+	out := make(chan *geography.MapTile)
+	params := DownloadParams{
+		GoroutinesNum: 2,
+		TryTimes:      1,
+	}
+	job := StartJob(context.Background(), params, initMapDescription(), out, loader)
+	for _ = range out {
+	}
+	err := job.Wait()
+	var tileErr *TileError
+	if !errors.As(err, &tileErr) {
+		t.Fatalf("TileErrors: got %v, want TileError.", err)
+	}
+	if tileErr.StatusCode != 503 || tileErr.Attempts != 1 || tileErr.Provider != "yandex" || len(tileErr.URL) == 0 {
+		t.Errorf("TileErrors: wrong error %+v.", tileErr)
+	}
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		t.Errorf("TileErrors: HTTPError is not wrapped.")
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok || len(joined.Unwrap()) != 2 {
+		t.Errorf("TileErrors: got %v, want errors of both tiles.", err)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	// The provider never answers.
+	stalled := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	tests := []struct {
+		name   string
+		params DownloadParams
+		want   error
+	}{
+		{"attempt", DownloadParams{AttemptTimeout: 10 * time.Millisecond}, ErrAttemptTimeout},
+		{"tile", DownloadParams{TileTimeout: 30 * time.Millisecond}, ErrTileTimeout},
+		{"job", DownloadParams{JobTimeout: 30 * time.Millisecond}, ErrJobTimeout},
+	}
+	for _, test := range tests {
+		out := make(chan *geography.MapTile)
+		params := test.params
+		params.GoroutinesNum = GOROUTINES_NUMBER
+		params.TryTimes = 2
+		job := StartJob(context.Background(), params, initMapDescription(), out, stalled)
+		for _ = range out {
+		}
+		err := job.Wait()
+		if !errors.Is(err, test.want) {
+			t.Errorf("Timeouts: %s timeout failed with %v.", test.name, err)
+		}
+		var tileErr *TileError
+		if isTile := errors.As(err, &tileErr); isTile != (test.name != "job") {
+			t.Errorf("Timeouts: %s timeout failed with %v.", test.name, err)
+		} else if isTile && test.name == "attempt" && tileErr.Attempts != 2 {
+			t.Errorf("Timeouts: attempts timed out %d times, want 2.", tileErr.Attempts)
+		}
+	}
+}
+
+func TestShards(t *testing.T) {
+	const SHARDS = 3
+	shardOf := make(map[tileKey]int)
+	for shard := 0; shard < SHARDS; shard++ {
+		params := DownloadParams{
+			GoroutinesNum: GOROUTINES_NUMBER,
+			TryTimes:      TRY_TIMES,
+			Shard:         shard,
+			Shards:        SHARDS,
+		}
+		it := Download(context.Background(), initMapDescription(), params, WithLoader(newTestLoader(0, 0)))
+		tiles := 0
+		for it.Next() {
+			tile := it.Tile()
+			key := tileKey{tile.Z, tile.X, tile.Y}
+			if other, ok := shardOf[key]; ok {
+				t.Errorf("Shards: tile %v is in shards %d and %d.", key, other, shard)
+			}
+			shardOf[key] = shard
+			tiles++
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("Shards: shard %d failed: %v.", shard, err)
+		}
+		if tiles == 0 {
+			t.Errorf("Shards: shard %d is empty.", shard)
+		}
+	}
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	all := 0
+	it := Download(context.Background(), initMapDescription(), params, WithLoader(newTestLoader(0, 0)))
+	for it.Next() {
+		all++
+	}
+	if all != len(shardOf) {
+		t.Errorf("Shards: shards have %d tiles, the map has %d.", len(shardOf), all)
+	}
+	for _, bad := range [][2]int{{3, 3}, {0, -1}, {1, 0}} {
+		params.Shard, params.Shards = bad[0], bad[1]
+		it = Download(context.Background(), initMapDescription(), params, WithLoader(newTestLoader(0, 0)))
+		for it.Next() {
+		}
+		if it.Err() == nil {
+			t.Errorf("Shards: shard %d of %d was accepted.", bad[0], bad[1])
+		}
+	}
+	if shard := ShardOf(10, 1, 2, 0); shard != 0 {
+		t.Errorf("Shards: tile is in shard %d of 0.", shard)
+	}
+}
+
+func TestLargeMap(t *testing.T) {
+	// Billions of tiles, they must be generated as they are downloaded.
+	mapDesc := initMapDescription()
+	mapDesc.MapArea = types.Polygon{
+		Vertices: []types.Point{
+			types.Point{40, -23},
+			types.Point{41, -22},
+		},
+	}
+	mapDesc.MinZoom, mapDesc.MaxZoom = MAX_ZOOM-1, MAX_ZOOM
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	it := Download(context.Background(), mapDesc, params, WithLoader(newTestLoader(0, 0)))
+	defer it.Close()
+	for i := 0; i < 10; i++ {
+		if !it.Next() {
+			t.Fatalf("LargeMap: download is over after %d tiles: %v.", i, it.Err())
+		}
+		if tile := it.Tile(); tile.Z != MAX_ZOOM-1 {
+			t.Errorf("LargeMap: got tile of zoom %d first.", tile.Z)
+		}
+	}
+}
+
+func TestTileList(t *testing.T) {
+	mapDesc := initMapDescription()
+	mapDesc.MapArea = types.Polygon{}
+	mapDesc.MinZoom, mapDesc.MaxZoom = 0, 0
+	mapDesc.Tiles = []geography.TileNum{{14, 7074, 6121}, {20, 1, 2}, {14, 7074, 6121}}
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	it := Download(context.Background(), mapDesc, params, WithLoader(newTestLoader(2, 1)))
+	got := make(map[tileKey]bool)
+	for it.Next() {
+		tile := it.Tile()
+		got[tileKey{tile.Z, tile.X, tile.Y}] = true
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("TileList: download failed: %v.", err)
+	}
+	if len(got) != 2 || !got[tileKey{14, 7074, 6121}] || !got[tileKey{20, 1, 2}] {
+		t.Errorf("TileList: got tiles %v.", got)
+	}
+	mapDesc.Tiles = []geography.TileNum{{2, 4, 0}}
+	it = Download(context.Background(), mapDesc, params, WithLoader(newTestLoader(0, 0)))
+	for it.Next() {
+	}
+	if it.Err() == nil {
+		t.Errorf("TileList: tile 2/4/0 was accepted.")
+	}
+}
+
+func TestRoute(t *testing.T) {
+	mapDesc := initMapDescription()
+	mapDesc.Route = &types.LineString{Points: mapDesc.MapArea.Vertices[:2]}
+	mapDesc.MapArea = types.Polygon{}
+	mapDesc.Buffer = 10
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	converter := MapProjects[mapDesc.Provider].Converter()
+	corridor, err := geography.CorridorTileSet(*mapDesc.Route, mapDesc.Buffer, mapDesc.MinZoom, mapDesc.MaxZoom, converter)
+	if err != nil {
+		t.Fatalf("Route: CorridorTileSet failed: %v.", err)
+	}
+	it := Download(context.Background(), mapDesc, params, WithLoader(newTestLoader(0, 0)))
+	tiles := 0
+	for it.Next() {
+		tile := it.Tile()
+		if !corridor.Contains(tile.Z, tile.X, tile.Y) {
+			t.Errorf("Route: tile %d/%d/%d is out of the corridor.", tile.Z, tile.X, tile.Y)
+		}
+		tiles++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Route: download failed: %v.", err)
+	}
+	if tiles != corridor.Len() {
+		t.Errorf("Route: got %d tiles of %d.", tiles, corridor.Len())
+	}
+	mapDesc.Buffer = -1
+	it = Download(context.Background(), mapDesc, params, WithLoader(newTestLoader(0, 0)))
+	for it.Next() {
+	}
+	if it.Err() == nil {
+		t.Errorf("Route: negative buffer was accepted.")
+	}
+}
+
+func TestLayers(t *testing.T) {
+	mapDesc := initMapDescription()
+	city := types.Polygon{Vertices: mapDesc.MapArea.Vertices[:2]}
+	mapDesc.Layers = []AreaLayer{
+		{Name: "country", MapArea: mapDesc.MapArea, MinZoom: 14, MaxZoom: 16},
+		{Name: "city", MapArea: city, MinZoom: 15, MaxZoom: 17},
+	}
+	mapDesc.MapArea = types.Polygon{}
+	converter := MapProjects[mapDesc.Provider].Converter()
+	layers := make([]*geography.TileSet, len(mapDesc.Layers))
+	tiles := &geography.TileSet{}
+	for i, layer := range mapDesc.Layers {
+		var err error
+		layers[i], err = geography.PolygonTileSet(layer.MapArea, layer.MinZoom, layer.MaxZoom, converter)
+		if err != nil {
+			t.Fatalf("Layers: PolygonTileSet failed: %v.", err)
+		}
+		tiles = tiles.Union(layers[i])
+	}
+	if shared := layers[0].Intersection(layers[1]).Len(); shared == 0 || tiles.Len() != layers[0].Len()+layers[1].Len()-shared {
+		t.Fatalf("Layers: %d tiles in layers of %d and %d tiles.", tiles.Len(), layers[0].Len(), layers[1].Len())
+	}
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	it := Download(context.Background(), mapDesc, params, WithLoader(newTestLoader(0, 0)))
+	got := make(map[tileKey]bool)
+	for it.Next() {
+		tile := it.Tile()
+		key := tileKey{tile.Z, tile.X, tile.Y}
+		if got[key] {
+			t.Errorf("Layers: tile %v is downloaded twice.", key)
+		}
+		got[key] = true
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Layers: download failed: %v.", err)
+	}
+	if len(got) != tiles.Len() {
+		t.Errorf("Layers: got %d tiles of %d.", len(got), tiles.Len())
+	}
+	progress := it.Job().Status().Progress
+	if len(progress.Layers) != 2 {
+		t.Fatalf("Layers: progress has %d layers.", len(progress.Layers))
+	}
+	for i, layer := range progress.Layers {
+		if layer.Name != mapDesc.Layers[i].Name || layer.Total != layers[i].Len() || layer.Done != layer.Total {
+			t.Errorf("Layers: progress of layer %d is %+v.", i, layer)
+		}
+	}
+	// Shards split layers as well.
+	totals := make([]int, len(layers))
+	params.Shards = 2
+	for params.Shard = 0; params.Shard < params.Shards; params.Shard++ {
+		it = Download(context.Background(), mapDesc, params, WithLoader(newTestLoader(0, 0)))
+		for it.Next() {
+		}
+		if err := it.Err(); err != nil {
+			t.Fatalf("Layers: shard %d failed: %v.", params.Shard, err)
+		}
+		for i, layer := range it.Job().Status().Progress.Layers {
+			if layer.Done != layer.Total {
+				t.Errorf("Layers: progress of layer %d in shard %d is %+v.", i, params.Shard, layer)
+			}
+			totals[i] += layer.Total
+		}
+	}
+	for i := range layers {
+		if totals[i] != layers[i].Len() {
+			t.Errorf("Layers: shards have %d tiles of layer %d of %d.", totals[i], i, layers[i].Len())
+		}
+	}
+	params.Shards = 0
+	mapDesc.Layers[1].MaxZoom = MAX_ZOOM + 1
+	it = Download(context.Background(), mapDesc, params, WithLoader(newTestLoader(0, 0)))
+	for it.Next() {
+	}
+	if it.Err() == nil {
+		t.Errorf("Layers: layer out of zoom range was accepted.")
+	}
+}
+
+func TestFallbacks(t *testing.T) {
+	registry := NewRegistry(MapProjects)
+	for name, conversion := range map[string]geography.Conversion{
+		"primary":   geography.EllipticalConversion{},
+		"backup":    geography.EllipticalConversion{},
+		"spherical": geography.SphericalConversion{},
+	} {
+		registry.Register(name, TemplateMaps{
+			URLs:       TypeToUrl{types.PLAN: name + "/{z}/{x}/{y}"},
+			Conversion: conversion,
+		})
+	}
+	// The primary provider fails tiles of even x
+	// and has placeholders for y divisible by 3.
+	client := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		var provider string
+		var z, x, y int
+		fmt.Sscanf(strings.Replace(url, "/", " ", -1), "%s %d %d %d", &provider, &z, &x, &y)
+		switch {
+		case provider == "primary" && x%2 == 0:
+			return nil, &HTTPError{URL: url, StatusCode: http.StatusNotFound}
+		case provider == "primary" && y%3 == 0:
+			return ioutil.NopCloser(strings.NewReader("placeholder")), nil
+		}
+		return ioutil.NopCloser(strings.NewReader(url)), nil
+	})
+	placeholder := WithPlaceholder(func(tile *geography.MapTile) bool {
+		return string(tile.Content) == "placeholder"
+	})
+	mapDesc := initMapDescription()
+	mapDesc.Provider = "primary"
+	mapDesc.Fallbacks = []string{"backup"}
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      1,
+	}
+	it := Download(context.Background(), mapDesc, params, WithLoader(client), WithRegistry(registry), placeholder)
+	providers := make(map[string]int)
+	for it.Next() {
+		tile := it.Tile()
+		want := "primary"
+		if tile.X%2 == 0 || tile.Y%3 == 0 {
+			want = "backup"
+		}
+		if tile.Provider != want || !strings.HasPrefix(string(tile.Content), want) {
+			t.Errorf("Fallbacks: tile %d/%d/%d is from %s, want %s.", tile.Z, tile.X, tile.Y, tile.Provider, want)
+		}
+		providers[tile.Provider]++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Fallbacks: download failed: %v.", err)
+	}
+	if providers["primary"] == 0 || providers["backup"] == 0 {
+		t.Errorf("Fallbacks: got tiles of %v.", providers)
+	}
+	// Without fallbacks placeholders are kept and failures fail.
+	mapDesc.Fallbacks = nil
+	it = Download(context.Background(), mapDesc, params, WithLoader(client), WithRegistry(registry), placeholder)
+	for it.Next() {
+	}
+	var tileErr *TileError
+	if !errors.As(it.Err(), &tileErr) || tileErr.Provider != "primary" {
+		t.Errorf("Fallbacks: got %v without fallbacks.", it.Err())
+	}
+	for _, fallbacks := range [][]string{{"spherical"}, {"yandex"}, {"unknown"}} {
+		mapDesc.Type = types.PLAN
+		if fallbacks[0] == "yandex" {
+			mapDesc.Type = types.HYBRID
+			registry.Register("primary", TemplateMaps{
+				URLs:       TypeToUrl{types.HYBRID: "primary/{z}/{x}/{y}"},
+				Conversion: geography.EllipticalConversion{},
+			})
+		}
+		mapDesc.Fallbacks = fallbacks
+		if err := checkInput(mapDesc, params, registry); err == nil {
+			t.Errorf("Fallbacks: fallback %s was accepted.", fallbacks[0])
+		}
+	}
+}
+
+func TestPlaceholderBudget(t *testing.T) {
+	registry := NewRegistry(MapProjects)
+	for _, name := range []string{"primary", "backup"} {
+		registry.Register(name, TemplateMaps{
+			URLs:       TypeToUrl{types.PLAN: name + "/{z}/{x}/{y}"},
+			Conversion: geography.EllipticalConversion{},
+		})
+	}
+	placeholderContent := strings.Repeat("p", 100)
+	// The primary provider has only placeholders, the backup one
+	// has them for x of 2.
+	client := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		if strings.HasPrefix(url, "primary") || strings.HasSuffix(url, "/2/2") {
+			return ioutil.NopCloser(strings.NewReader(placeholderContent)), nil
+		}
+		return ioutil.NopCloser(strings.NewReader(strings.Repeat("b", 100))), nil
+	})
+	mapDesc := initMapDescription()
+	mapDesc.Type = types.PLAN
+	mapDesc.Provider = "primary"
+	mapDesc.Fallbacks = []string{"backup"}
+	mapDesc.Tiles = []geography.TileNum{{Z: 10, X: 1, Y: 1}, {Z: 10, X: 2, Y: 2}, {Z: 10, X: 3, Y: 3}}
+	// A placeholder and a tile of the fallback don't fit the budget together.
+	params := DownloadParams{
+		GoroutinesNum:    1,
+		TryTimes:         1,
+		MaxBytesInFlight: 150,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	it := Download(ctx, mapDesc, params, WithLoader(client), WithRegistry(registry), WithPlaceholder(func(tile *geography.MapTile) bool {
+		return string(tile.Content) == placeholderContent
+	}))
+	providers := make(map[string]int)
+	for it.Next() {
+		providers[it.Tile().Provider]++
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("PlaceholderBudget: download failed: %v.", err)
+	}
+	if providers["backup"] != 2 || providers["primary"] != 1 {
+		t.Errorf("PlaceholderBudget: got tiles of %v.", providers)
+	}
+}
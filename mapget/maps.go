@@ -1,7 +1,11 @@
 package mapget
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/PlaceDescriber/PlaceDescriber/geography"
 	"github.com/PlaceDescriber/PlaceDescriber/types"
@@ -14,6 +18,50 @@ type MapProject interface {
 	GetURL(x, y, z, scale int, language string, mapType types.MapType) (string, error)
 }
 
+// RequestProject is a MapProject whose requests need headers,
+// e.g. signed ones. Headers are passed to the loader with ctx,
+// see WithHeader.
+type RequestProject interface {
+	MapProject
+	GetRequest(ctx context.Context, x, y, z, scale int, language string, mapType types.MapType) (string, http.Header, error)
+}
+
+type headerKey struct{}
+
+// WithHeader returns ctx carrying headers of the request.
+func WithHeader(ctx context.Context, header http.Header) context.Context {
+	return context.WithValue(ctx, headerKey{}, header)
+}
+
+// HeaderFromContext returns headers of the request set by WithHeader.
+func HeaderFromContext(ctx context.Context) http.Header {
+	header, _ := ctx.Value(headerKey{}).(http.Header)
+	return header
+}
+
+type providerKey struct{}
+
+// WithProvider returns ctx carrying the name of the provider requested.
+func WithProvider(ctx context.Context, provider string) context.Context {
+	return context.WithValue(ctx, providerKey{}, provider)
+}
+
+// ProviderFromContext returns the provider of the request set by
+// WithProvider, jobs set it for loaders.
+func ProviderFromContext(ctx context.Context) string {
+	provider, _ := ctx.Value(providerKey{}).(string)
+	return provider
+}
+
+// Projections of providers by name, e.g. in configs of plugins.
+var StrToConversion = map[string]geography.Conversion{
+	"spherical":  geography.SphericalConversion{},
+	"elliptical": geography.EllipticalConversion{},
+}
+
+// MapProjects are the default providers, downloads without WithRegistry
+// copy them when they start. Use a Registry to add providers while
+// downloads are running.
 // TODO: support more map providers.
 var MapProjects = map[string]MapProject{
 	"yandex": YandexMaps{},
@@ -41,3 +89,33 @@ func (s YandexMaps) GetURL(
 	}
 	return fmt.Sprintf(url, x, y, z, scale, language), nil
 }
+
+// TemplateMaps is a provider with tile URLs built from templates
+// with {x}, {y}, {z}, {scale} and {lang} placeholders.
+type TemplateMaps struct {
+	URLs       TypeToUrl
+	Conversion geography.Conversion
+}
+
+func (s TemplateMaps) Converter() geography.Conversion {
+	return s.Conversion
+}
+
+func (s TemplateMaps) GetURL(
+	x, y, z, scale int,
+	language string,
+	mapType types.MapType,
+) (string, error) {
+	url, ok := s.URLs[mapType]
+	if !ok {
+		return "", fmt.Errorf("TemplateMaps doesn't support map type %d", mapType)
+	}
+	replacer := strings.NewReplacer(
+		"{x}", strconv.Itoa(x),
+		"{y}", strconv.Itoa(y),
+		"{z}", strconv.Itoa(z),
+		"{scale}", strconv.Itoa(scale),
+		"{lang}", language,
+	)
+	return replacer.Replace(url), nil
+}
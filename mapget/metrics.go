@@ -0,0 +1,130 @@
+package mapget
+
+// metrics.go: Prometheus metrics of downloads.
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics holds the collectors updated by DownloadMap. A nil *Metrics
+// is valid and records nothing.
+type Metrics struct {
+	Requests      *prometheus.CounterVec
+	Latency       *prometheus.HistogramVec
+	Retries       *prometheus.CounterVec
+	Bytes         *prometheus.CounterVec
+	Tiles         *prometheus.CounterVec
+	QueueDepth    prometheus.Gauge
+	ActiveWorkers prometheus.Gauge
+}
+
+// NewMetrics creates the collectors and registers them in reg.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mapget_requests_total",
+			Help: "Tile requests by provider and HTTP status.",
+		}, []string{"provider", "status"}),
+		Latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mapget_request_duration_seconds",
+			Help:    "Duration of tile requests including reading the body.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		}, []string{"provider"}),
+		Retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mapget_retries_total",
+			Help: "Repeated tile requests.",
+		}, []string{"provider"}),
+		Bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mapget_downloaded_bytes_total",
+			Help: "Size of downloaded tiles.",
+		}, []string{"provider"}),
+		Tiles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mapget_tiles_total",
+			Help: "Downloaded tiles by provider and zoom.",
+		}, []string{"provider", "zoom"}),
+		QueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mapget_queue_depth",
+			Help: "Tiles created and waiting for a worker.",
+		}),
+		ActiveWorkers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mapget_active_workers",
+			Help: "Workers downloading tiles.",
+		}),
+	}
+	reg.MustRegister(
+		m.Requests,
+		m.Latency,
+		m.Retries,
+		m.Bytes,
+		m.Tiles,
+		m.QueueDepth,
+		m.ActiveWorkers,
+	)
+	return m
+}
+
+// WithMetrics makes DownloadMap update m.
+func WithMetrics(m *Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+	}
+}
+
+// statusLabel returns the status of a request for metrics.
+func statusLabel(err error) string {
+	if err == nil {
+		return "200"
+	}
+	var httpErr *HTTPError
+	switch {
+	case errors.As(err, &httpErr):
+		return strconv.Itoa(httpErr.StatusCode)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrAttemptTimeout), errors.Is(err, ErrTileTimeout):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "cancelled"
+	}
+	return "error"
+}
+
+func (m *Metrics) request(provider string, latency time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.Requests.WithLabelValues(provider, statusLabel(err)).Inc()
+	m.Latency.WithLabelValues(provider).Observe(latency.Seconds())
+}
+
+func (m *Metrics) retry(provider string) {
+	if m == nil {
+		return
+	}
+	m.Retries.WithLabelValues(provider).Inc()
+}
+
+func (m *Metrics) tile(provider string, z int, size int64) {
+	if m == nil {
+		return
+	}
+	m.Tiles.WithLabelValues(provider, strconv.Itoa(z)).Inc()
+	m.Bytes.WithLabelValues(provider).Add(float64(size))
+}
+
+func (m *Metrics) queued(delta int) {
+	if m == nil {
+		return
+	}
+	m.QueueDepth.Add(float64(delta))
+}
+
+func (m *Metrics) workers(active int) {
+	if m == nil {
+		return
+	}
+	m.ActiveWorkers.Set(float64(active))
+}
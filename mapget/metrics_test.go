@@ -0,0 +1,107 @@
+package mapget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	var wg sync.WaitGroup
+	var err error
+	metrics := NewMetrics(prometheus.NewRegistry())
+	out := make(chan *geography.MapTile)
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = DownloadMap(
+			context.Background(),
+			params,
+			initMapDescription(),
+			out,
+			newTestLoader(1, 2),
+			WithMetrics(metrics),
+		)
+	}()
+	tiles, size, zoom14 := 0, 0, 0
+	for tile := range out {
+		tiles++
+		size += len(tile.Content)
+		if tile.Z == 14 {
+			zoom14++
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Metrics: DownloadMap failed: %v.", err)
+	}
+	if n := testutil.ToFloat64(metrics.Requests.WithLabelValues("yandex", "200")); int(n) != tiles {
+		t.Errorf("Metrics: %v successful requests, want %d.", n, tiles)
+	}
+	if n := testutil.ToFloat64(metrics.Requests.WithLabelValues("yandex", "error")); n != 2 {
+		t.Errorf("Metrics: %v failed requests, want 2.", n)
+	}
+	if n := testutil.ToFloat64(metrics.Retries.WithLabelValues("yandex")); n != 2 {
+		t.Errorf("Metrics: %v retries, want 2.", n)
+	}
+	if n := testutil.ToFloat64(metrics.Bytes.WithLabelValues("yandex")); int(n) != size {
+		t.Errorf("Metrics: %v bytes, want %d.", n, size)
+	}
+	if n := testutil.ToFloat64(metrics.Tiles.WithLabelValues("yandex", "14")); int(n) != zoom14 {
+		t.Errorf("Metrics: %v tiles at zoom 14, want %d.", n, zoom14)
+	}
+	if n := testutil.ToFloat64(metrics.QueueDepth); n != 0 {
+		t.Errorf("Metrics: queue depth is %v after the download.", n)
+	}
+	if n := testutil.ToFloat64(metrics.ActiveWorkers); n != 0 {
+		t.Errorf("Metrics: %v active workers after the download.", n)
+	}
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	client := Chain(LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(url)), nil
+	}), MetricsMiddleware(metrics))
+	// A loader shared by providers labels requests by their provider.
+	for _, provider := range []string{"first", "second", "second"} {
+		if _, err := client.Do(WithProvider(context.Background(), provider), "url"); err != nil {
+			t.Fatalf("MetricsMiddleware: Do failed: %v.", err)
+		}
+	}
+	if n := testutil.ToFloat64(metrics.Requests.WithLabelValues("first", "200")); n != 1 {
+		t.Errorf("MetricsMiddleware: %v requests of first, want 1.", n)
+	}
+	if n := testutil.ToFloat64(metrics.Requests.WithLabelValues("second", "200")); n != 2 {
+		t.Errorf("MetricsMiddleware: %v requests of second, want 2.", n)
+	}
+}
+
+func TestStatusLabel(t *testing.T) {
+	for err, want := range map[error]string{
+		nil:                                   "200",
+		&HTTPError{StatusCode: 503}:           "503",
+		context.DeadlineExceeded:              "timeout",
+		ErrAttemptTimeout:                     "timeout",
+		fmt.Errorf("get: %w", ErrTileTimeout): "timeout",
+		context.Canceled:                      "cancelled",
+		errors.New("other"):                   "error",
+	} {
+		if got := statusLabel(err); got != want {
+			t.Errorf("StatusLabel: %v is labeled %q, want %q.", err, got, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package mapget
+
+// middleware.go: decorators of Loader.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LoaderFunc is an adapter to use ordinary functions as Loader.
+type LoaderFunc func(ctx context.Context, url string) (io.ReadCloser, error)
+
+func (f LoaderFunc) Do(ctx context.Context, url string) (io.ReadCloser, error) {
+	return f(ctx, url)
+}
+
+// Middleware wraps a Loader adding some behaviour to it.
+type Middleware func(Loader) Loader
+
+// Chain wraps client in middlewares. The first middleware is the
+// outermost one, so it sees requests first and responses last.
+func Chain(client Loader, middlewares ...Middleware) Loader {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		client = middlewares[i](client)
+	}
+	return client
+}
+
+// LoggingMiddleware logs every request at debug level
+// and failed ones at warn level.
+func LoggingMiddleware(logger *slog.Logger) Middleware {
+	return func(next Loader) Loader {
+		return LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+			start := time.Now()
+			body, err := next.Do(ctx, url)
+			attrs := []slog.Attr{
+				slog.String("url", url),
+				slog.Duration("duration", time.Since(start)),
+			}
+			if err != nil {
+				attrs = append(attrs, slog.Any("error", err))
+				logger.LogAttrs(ctx, slog.LevelWarn, "Request failed", attrs...)
+			} else {
+				logger.LogAttrs(ctx, slog.LevelDebug, "Request", attrs...)
+			}
+			return body, err
+		})
+	}
+}
+
+// MetricsMiddleware records requests and their latency in m labeled
+// with the provider of the request, see ProviderFromContext. Don't use
+// it together with WithMetrics for the same Metrics, requests would be
+// counted twice.
+func MetricsMiddleware(m *Metrics) Middleware {
+	return func(next Loader) Loader {
+		return LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+			start := time.Now()
+			body, err := next.Do(ctx, url)
+			m.request(ProviderFromContext(ctx), time.Since(start), err)
+			return body, err
+		})
+	}
+}
+
+// rateLimiter spaces events by the interval.
+type rateLimiter struct {
+	mtx      sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// wait blocks until the next event is allowed.
+func (r *rateLimiter) wait(ctx context.Context) error {
+	r.mtx.Lock()
+	now := time.Now()
+	at := r.next
+	if at.Before(now) {
+		at = now
+	}
+	r.next = at.Add(r.interval)
+	r.mtx.Unlock()
+	delay := at.Sub(now)
+	if delay <= 0 {
+		return nil
+	}
+	return sleep(ctx, delay)
+}
+
+// RateLimitMiddleware lets at most perSecond requests through per second.
+func RateLimitMiddleware(perSecond float64) Middleware {
+	limiter := newRateLimiter(perSecond)
+	return func(next Loader) Loader {
+		return LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+			if err := limiter.wait(ctx); err != nil {
+				return nil, err
+			}
+			return next.Do(ctx, url)
+		})
+	}
+}
+
+// ErrInjectedFault is returned by requests failed by FaultMiddleware.
+var ErrInjectedFault = errors.New("injected fault")
+
+// FaultMiddleware fails the given share of requests with
+// ErrInjectedFault, the choice is reproducible for the same seed.
+func FaultMiddleware(rate float64, seed int64) Middleware {
+	var mtx sync.Mutex
+	random := rand.New(rand.NewSource(seed))
+	return func(next Loader) Loader {
+		return LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+			mtx.Lock()
+			fail := random.Float64() < rate
+			mtx.Unlock()
+			if fail {
+				return nil, ErrInjectedFault
+			}
+			return next.Do(ctx, url)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package mapget
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func echoLoader() Loader {
+	return LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(url)), nil
+	})
+}
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next Loader) Loader {
+			return LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+				order = append(order, name)
+				return next.Do(ctx, url+name)
+			})
+		}
+	}
+	client := Chain(echoLoader(), mark("a"), mark("b"), mark("c"))
+	body, err := client.Do(context.Background(), "url:")
+	if err != nil {
+		t.Fatalf("Chain: Do failed: %v.", err)
+	}
+	content, _ := ioutil.ReadAll(body)
+	if string(content) != "url:abc" || strings.Join(order, "") != "abc" {
+		t.Errorf("Chain: middlewares applied in wrong order: %q, %v.", content, order)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	client := Chain(echoLoader(), RateLimitMiddleware(100))
+	start := time.Now()
+	for i := 0; i < 11; i++ {
+		if _, err := client.Do(context.Background(), "url"); err != nil {
+			t.Fatalf("RateLimit: Do failed: %v.", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("RateLimit: 11 requests at 100 per second took %v.", elapsed)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	client = Chain(echoLoader(), RateLimitMiddleware(0.001))
+	client.Do(ctx, "url")
+	if _, err := client.Do(ctx, "url"); err != context.Canceled {
+		t.Errorf("RateLimit: waiting ignored the context: %v.", err)
+	}
+}
+
+func TestFaultMiddleware(t *testing.T) {
+	client := Chain(echoLoader(), FaultMiddleware(0.3, 1))
+	fails := 0
+	for i := 0; i < 1000; i++ {
+		if _, err := client.Do(context.Background(), "url"); err == ErrInjectedFault {
+			fails++
+		}
+	}
+	if fails < 250 || fails > 350 {
+		t.Errorf("FaultMiddleware: %d of 1000 requests failed with rate 0.3.", fails)
+	}
+}
@@ -0,0 +1,373 @@
+package mapget
+
+// plugin.go: providers backed by external executables, e.g. for URL
+// signing schemes that can't be put into configs.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+	"github.com/PlaceDescriber/PlaceDescriber/types"
+)
+
+const (
+	// DEFAULT_PLUGIN_BATCH is the batch size of plugins without BatchSize.
+	DEFAULT_PLUGIN_BATCH = 64
+	// DEFAULT_PLUGIN_TIMEOUT is the timeout of plugins without Timeout.
+	DEFAULT_PLUGIN_TIMEOUT = 30 * time.Second
+	// PLUGIN_STOP_TIMEOUT is how long a plugin may take to exit
+	// after its stdin is closed, it is killed then.
+	PLUGIN_STOP_TIMEOUT = 5 * time.Second
+)
+
+// ErrPluginClosed is returned by requests to a closed plugin.
+var ErrPluginClosed = errors.New("plugin closed")
+
+// PluginParams describes a provider backed by an executable.
+type PluginParams struct {
+	// Name is the provider name the plugin is registered with.
+	Name string `json:"name"`
+	// Command is the executable and its arguments.
+	Command []string `json:"command"`
+	// Projection is a key of StrToConversion.
+	Projection string `json:"projection"`
+	// BatchSize is the maximal number of tiles in a request.
+	BatchSize int `json:"batch_size"`
+	// Timeout is how long the plugin may take to answer a request,
+	// it is killed then, failing the request, and started again.
+	Timeout time.Duration `json:"timeout"`
+}
+
+// pluginTile is a tile in a request to the plugin.
+type pluginTile struct {
+	Z        int    `json:"z"`
+	X        int    `json:"x"`
+	Y        int    `json:"y"`
+	Scale    int    `json:"scale"`
+	Language string `json:"language"`
+	Type     string `json:"type"`
+}
+
+type pluginRequest struct {
+	Tiles []pluginTile `json:"tiles"`
+}
+
+// pluginURL is the answer of the plugin for a tile.
+type pluginURL struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+type pluginResponse struct {
+	Tiles []pluginURL `json:"tiles"`
+	Error string      `json:"error,omitempty"`
+}
+
+// pluginCall is a tile waiting for its URL.
+type pluginCall struct {
+	tile  pluginTile
+	reply chan pluginReply
+}
+
+type pluginReply struct {
+	url    string
+	header http.Header
+	err    error
+}
+
+// PluginMaps is a provider with URLs made by an external executable.
+// The executable reads requests from stdin and writes responses to
+// stdout, a JSON object per line:
+//
+//	{"tiles": [{"z": 10, "x": 617, "y": 320, "scale": 1, "language": "en_EN", "type": "satellite"}]}
+//	{"tiles": [{"url": "https://...", "headers": {"Authorization": "..."}}]}
+//
+// A response has the tiles of the request in their order. A tile with
+// "error" set fails alone, "error" of the response fails all its tiles.
+// Concurrent requests of tiles are sent in batches of up to BatchSize.
+// The executable is started again after it fails.
+type PluginMaps struct {
+	params     PluginParams
+	conversion geography.Conversion
+	calls      chan *pluginCall
+	done       chan struct{}
+	closeOnce  sync.Once
+	stopped    chan struct{}
+
+	// The process is used only by loop, process is also
+	// killed by Close if loop is stuck.
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	mtx     sync.Mutex
+	process *os.Process
+}
+
+// StartPlugin starts the executable of the plugin, it must be stopped
+// with Close. The plugin is a provider to Register as params.Name.
+func StartPlugin(params PluginParams) (*PluginMaps, error) {
+	if len(params.Command) == 0 {
+		return nil, fmt.Errorf("Plugin %s has no command", params.Name)
+	}
+	conversion, ok := StrToConversion[params.Projection]
+	if !ok {
+		return nil, fmt.Errorf("Plugin %s has bad projection %q", params.Name, params.Projection)
+	}
+	if params.BatchSize <= 0 {
+		params.BatchSize = DEFAULT_PLUGIN_BATCH
+	}
+	if params.Timeout <= 0 {
+		params.Timeout = DEFAULT_PLUGIN_TIMEOUT
+	}
+	p := &PluginMaps{
+		params:     params,
+		conversion: conversion,
+		calls:      make(chan *pluginCall),
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	go p.loop()
+	return p, nil
+}
+
+func (p *PluginMaps) Converter() geography.Conversion {
+	return p.conversion
+}
+
+func (p *PluginMaps) GetURL(
+	x, y, z, scale int,
+	language string,
+	mapType types.MapType,
+) (string, error) {
+	url, _, err := p.GetRequest(context.Background(), x, y, z, scale, language, mapType)
+	return url, err
+}
+
+// GetRequest returns the URL of the tile and headers of its request.
+func (p *PluginMaps) GetRequest(
+	ctx context.Context,
+	x, y, z, scale int,
+	language string,
+	mapType types.MapType,
+) (string, http.Header, error) {
+	typeStr, ok := types.MapTypeToStr[mapType]
+	if !ok {
+		return "", nil, fmt.Errorf("Plugin %s: bad map type %d", p.params.Name, mapType)
+	}
+	call := &pluginCall{
+		tile: pluginTile{
+			Z:        z,
+			X:        x,
+			Y:        y,
+			Scale:    scale,
+			Language: language,
+			Type:     typeStr,
+		},
+		reply: make(chan pluginReply, 1),
+	}
+	select {
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	case <-p.done:
+		return "", nil, ErrPluginClosed
+	case p.calls <- call:
+	}
+	select {
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	case reply := <-call.reply:
+		return reply.url, reply.header, reply.err
+	}
+}
+
+// Close stops the executable.
+func (p *PluginMaps) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	select {
+	case <-p.stopped:
+		return nil
+	case <-time.After(PLUGIN_STOP_TIMEOUT):
+	}
+	// The executable doesn't answer.
+	p.kill()
+	<-p.stopped
+	return nil
+}
+
+func (p *PluginMaps) kill() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.process != nil {
+		p.process.Kill()
+	}
+}
+
+// loop sends waiting calls to the executable in batches.
+func (p *PluginMaps) loop() {
+	defer close(p.stopped)
+	defer p.stop()
+	for {
+		var batch []*pluginCall
+		select {
+		case <-p.done:
+			return
+		case call := <-p.calls:
+			batch = append(batch, call)
+		}
+	gather:
+		for len(batch) < p.params.BatchSize {
+			select {
+			case call := <-p.calls:
+				batch = append(batch, call)
+			default:
+				break gather
+			}
+		}
+		replies, err := p.exchange(batch)
+		for i, call := range batch {
+			if err != nil {
+				call.reply <- pluginReply{err: err}
+			} else {
+				call.reply <- replies[i]
+			}
+		}
+	}
+}
+
+// exchange sends the batch to the executable and reads the URLs.
+func (p *PluginMaps) exchange(batch []*pluginCall) ([]pluginReply, error) {
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			return nil, err
+		}
+	}
+	req := pluginRequest{Tiles: make([]pluginTile, len(batch))}
+	for i, call := range batch {
+		req.Tiles[i] = call.tile
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var res pluginResponse
+	err = p.roundTrip(append(data, '\n'), &res)
+	if err != nil {
+		// Start it again for the next batch.
+		p.stop()
+		return nil, fmt.Errorf("Plugin %s failed: %v", p.params.Name, err)
+	}
+	if len(res.Error) != 0 {
+		return nil, fmt.Errorf("Plugin %s: %s", p.params.Name, res.Error)
+	}
+	if len(res.Tiles) != len(batch) {
+		p.stop()
+		return nil, fmt.Errorf("Plugin %s answered %d tiles of %d", p.params.Name, len(res.Tiles), len(batch))
+	}
+	replies := make([]pluginReply, len(batch))
+	for i, tile := range res.Tiles {
+		if len(tile.Error) != 0 {
+			replies[i].err = fmt.Errorf("Plugin %s: %s", p.params.Name, tile.Error)
+			continue
+		}
+		replies[i].url = tile.URL
+		if len(tile.Headers) != 0 {
+			replies[i].header = make(http.Header, len(tile.Headers))
+			for key, value := range tile.Headers {
+				replies[i].header.Set(key, value)
+			}
+		}
+	}
+	return replies, nil
+}
+
+// roundTrip writes the request and reads the response, the executable
+// is killed if it doesn't answer in time.
+func (p *PluginMaps) roundTrip(req []byte, res *pluginResponse) error {
+	type answer struct {
+		line []byte
+		err  error
+	}
+	// The pipes are closed by stop, which ends the goroutine.
+	answers := make(chan answer, 1)
+	go func(stdin io.Writer, stdout *bufio.Reader) {
+		if _, err := stdin.Write(req); err != nil {
+			answers <- answer{err: err}
+			return
+		}
+		line, err := stdout.ReadBytes('\n')
+		answers <- answer{line, err}
+	}(p.stdin, p.stdout)
+	timer := time.NewTimer(p.params.Timeout)
+	defer timer.Stop()
+	select {
+	case a := <-answers:
+		if a.err != nil {
+			return a.err
+		}
+		return json.Unmarshal(a.line, res)
+	case <-timer.C:
+		p.kill()
+		return fmt.Errorf("no answer in %v", p.params.Timeout)
+	}
+}
+
+// start starts the executable.
+func (p *PluginMaps) start() error {
+	cmd := exec.Command(p.params.Command[0], p.params.Command[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Plugin %s can't start: %v", p.params.Name, err)
+	}
+	p.cmd, p.stdin, p.stdout = cmd, stdin, bufio.NewReader(stdout)
+	p.mtx.Lock()
+	p.process = cmd.Process
+	p.mtx.Unlock()
+	return nil
+}
+
+// stop closes stdin of the executable and waits for it to exit.
+func (p *PluginMaps) stop() {
+	if p.cmd == nil {
+		return
+	}
+	p.stdin.Close()
+	exited := make(chan struct{})
+	go func(cmd *exec.Cmd) {
+		cmd.Wait()
+		close(exited)
+	}(p.cmd)
+	select {
+	case <-exited:
+	case <-time.After(PLUGIN_STOP_TIMEOUT):
+		p.kill()
+		<-exited
+	}
+	p.mtx.Lock()
+	p.process = nil
+	p.mtx.Unlock()
+	p.cmd = nil
+}
@@ -0,0 +1,130 @@
+package mapget
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs the test binary as a plugin when PLUGIN_TEST is set.
+func TestMain(m *testing.M) {
+	switch os.Getenv("PLUGIN_TEST") {
+	case "1":
+		runTestPlugin()
+		return
+	case "hang":
+		// The plugin never answers.
+		ioutil.ReadAll(os.Stdin)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runTestPlugin signs URLs of tiles, it fails tiles of zoom 1.
+func runTestPlugin() {
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req pluginRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			fmt.Printf("{\"error\": %q}\n", err.Error())
+			continue
+		}
+		var res pluginResponse
+		for _, tile := range req.Tiles {
+			if tile.Z == 1 {
+				res.Tiles = append(res.Tiles, pluginURL{Error: "no tiles of zoom 1"})
+				continue
+			}
+			res.Tiles = append(res.Tiles, pluginURL{
+				URL:     fmt.Sprintf("signed/%s/%d/%d/%d?batch=%d", tile.Type, tile.Z, tile.X, tile.Y, len(req.Tiles)),
+				Headers: map[string]string{"X-Signature": fmt.Sprintf("%d-%d-%d", tile.Z, tile.X, tile.Y)},
+			})
+		}
+		data, _ := json.Marshal(res)
+		fmt.Printf("%s\n", data)
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	t.Setenv("PLUGIN_TEST", "1")
+	plugin, err := StartPlugin(PluginParams{
+		Name:       "signed",
+		Command:    []string{os.Args[0]},
+		Projection: "elliptical",
+		BatchSize:  4,
+	})
+	if err != nil {
+		t.Fatalf("Plugin: StartPlugin failed: %v.", err)
+	}
+	defer plugin.Close()
+	registry := NewRegistry(MapProjects)
+	registry.Register("signed", plugin)
+
+	if _, err := plugin.GetURL(0, 0, 1, 1, "en_EN", 0); err == nil {
+		t.Errorf("Plugin: tile failed by the plugin has URL.")
+	}
+	client := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		var z, x, y, batch int
+		fmt.Sscanf(url, "signed/plan/%d/%d/%d?batch=%d", &z, &x, &y, &batch)
+		if batch < 1 || batch > 4 {
+			t.Errorf("Plugin: batch of %d tiles.", batch)
+		}
+		if signature := HeaderFromContext(ctx).Get("X-Signature"); signature != fmt.Sprintf("%d-%d-%d", z, x, y) {
+			t.Errorf("Plugin: %s has signature %q.", url, signature)
+		}
+		return ioutil.NopCloser(strings.NewReader(url)), nil
+	})
+	mapDesc := initMapDescription()
+	mapDesc.Provider = "signed"
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	summary, err := DownloadToStore(context.Background(), mapDesc, params, DirStore{Path: t.TempDir()}, WithLoader(client), WithRegistry(registry))
+	if err != nil {
+		t.Fatalf("Plugin: download failed: %v.", err)
+	}
+	if summary.Done == 0 || summary.Outcomes[OUTCOME_DOWNLOADED] != summary.Done {
+		t.Errorf("Plugin: got %+v.", summary)
+	}
+	plugin.Close()
+	if _, err := plugin.GetURL(0, 0, 2, 1, "en_EN", 0); err != ErrPluginClosed {
+		t.Errorf("Plugin: closed plugin returned %v.", err)
+	}
+}
+
+func TestPluginTimeout(t *testing.T) {
+	t.Setenv("PLUGIN_TEST", "hang")
+	plugin, err := StartPlugin(PluginParams{
+		Name:       "hanging",
+		Command:    []string{os.Args[0]},
+		Projection: "elliptical",
+		Timeout:    100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("PluginTimeout: StartPlugin failed: %v.", err)
+	}
+	defer plugin.Close()
+	// The plugin is started again for each request.
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		if _, err := plugin.GetURL(0, 0, 2, 1, "en_EN", 0); err == nil || time.Since(start) > time.Second {
+			t.Errorf("PluginTimeout: got %v after %v.", err, time.Since(start))
+		}
+	}
+	// Checks of fallbacks don't make requests to plugins.
+	registry := NewRegistry(MapProjects)
+	registry.Register("hanging", plugin)
+	mapDesc := initMapDescription()
+	mapDesc.Fallbacks = []string{"hanging"}
+	if err := checkInput(mapDesc, DownloadParams{GoroutinesNum: 1, TryTimes: 1}, registry); err != nil {
+		t.Errorf("PluginTimeout: fallback was rejected: %v.", err)
+	}
+}
@@ -0,0 +1,287 @@
+package mapget
+
+// quota.go: usage quotas of providers kept in a file, so that they
+// hold across jobs and processes run one after another.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+type QuotaPeriod int
+
+const (
+	QUOTA_DAY QuotaPeriod = iota
+	QUOTA_MONTH
+)
+
+var QuotaPeriodToStr = map[QuotaPeriod]string{
+	QUOTA_DAY:   "day",
+	QUOTA_MONTH: "month",
+}
+
+func (p QuotaPeriod) String() string {
+	return QuotaPeriodToStr[p]
+}
+
+func (p QuotaPeriod) MarshalText() ([]byte, error) {
+	s, ok := QuotaPeriodToStr[p]
+	if !ok {
+		return nil, fmt.Errorf("Bad quota period %d", int(p))
+	}
+	return []byte(s), nil
+}
+
+func (p *QuotaPeriod) UnmarshalText(text []byte) error {
+	for period, s := range QuotaPeriodToStr {
+		if s == string(text) {
+			*p = period
+			return nil
+		}
+	}
+	return fmt.Errorf("Bad quota period %q", text)
+}
+
+// start returns the beginning of the period containing t, in UTC.
+func (p QuotaPeriod) start(t time.Time) time.Time {
+	t = t.UTC()
+	if p == QUOTA_MONTH {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// QUOTA_RESERVE is how many requests are written to the counter file
+// ahead of use, so the file is rewritten once in QUOTA_RESERVE
+// requests and a crash never makes it count less than was used.
+const QUOTA_RESERVE = 100
+
+// ErrQuotaExceeded is wrapped by errors of jobs stopped by a quota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits requests to the provider in a period.
+type Quota struct {
+	Provider string      `json:"provider"`
+	Limit    int         `json:"limit"`
+	Period   QuotaPeriod `json:"period"`
+}
+
+// quotaUsage is the state of a quota in the counter file.
+type quotaUsage struct {
+	Start time.Time `json:"start"`
+	Used  int       `json:"used"`
+}
+
+// Quotas counts requests to providers against their quotas. Requests
+// served by DiskCache are not counted, tiles of the cache given with
+// WithCache are served after a quota is used up. A nil *Quotas has
+// no quotas.
+type Quotas struct {
+	path   string
+	quotas map[string]Quota
+	now    func() time.Time
+
+	mtx   sync.Mutex
+	usage map[string]*quotaUsage
+	// saved is the usage written to the file.
+	saved map[string]int
+}
+
+// OpenQuotas opens the counter file at path, it is created by the
+// first request if it does not exist.
+func OpenQuotas(path string, quotas []Quota) (*Quotas, error) {
+	q := &Quotas{
+		path:   path,
+		quotas: make(map[string]Quota),
+		now:    time.Now,
+		usage:  make(map[string]*quotaUsage),
+		saved:  make(map[string]int),
+	}
+	for _, quota := range quotas {
+		if quota.Limit < 0 {
+			return nil, fmt.Errorf("Quota of %s is negative: %d", quota.Provider, quota.Limit)
+		}
+		q.quotas[quota.Provider] = quota
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.usage); err != nil {
+		return nil, fmt.Errorf("Bad quota file %s: %v", path, err)
+	}
+	for provider, usage := range q.usage {
+		q.saved[provider] = usage.Used
+	}
+	return q, nil
+}
+
+// current returns the usage of the quota in the current period.
+// It must be called with mtx held.
+func (q *Quotas) current(quota Quota) *quotaUsage {
+	start := quota.Period.start(q.now())
+	usage, ok := q.usage[quota.Provider]
+	if !ok || !usage.Start.Equal(start) {
+		usage = &quotaUsage{Start: start}
+		q.usage[quota.Provider] = usage
+		q.saved[quota.Provider] = 0
+	}
+	return usage
+}
+
+// Remaining returns how many requests to the provider are left in the
+// current period, ok is false if the provider has no quota.
+func (q *Quotas) Remaining(provider string) (n int, ok bool) {
+	if q == nil {
+		return 0, false
+	}
+	quota, ok := q.quotas[provider]
+	if !ok {
+		return 0, false
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return max(quota.Limit-q.current(quota).Used, 0), true
+}
+
+// take counts a request to the provider, it fails if the quota
+// is used up.
+func (q *Quotas) take(provider string) error {
+	if q == nil {
+		return nil
+	}
+	quota, ok := q.quotas[provider]
+	if !ok {
+		return nil
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	usage := q.current(quota)
+	if usage.Used >= quota.Limit {
+		return fmt.Errorf("Provider %s used %d requests of its %s quota: %w", provider, usage.Used, quota.Period, ErrQuotaExceeded)
+	}
+	usage.Used++
+	if usage.Used > q.saved[provider] {
+		return q.save()
+	}
+	return nil
+}
+
+// refund takes back a request counted by take that did not reach
+// the provider.
+func (q *Quotas) refund(provider string) {
+	if q == nil {
+		return
+	}
+	if _, ok := q.quotas[provider]; !ok {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if usage := q.usage[provider]; usage != nil && usage.Used > 0 {
+		usage.Used--
+	}
+}
+
+// save writes the usage to the file with QUOTA_RESERVE requests
+// ahead. It must be called with mtx held.
+func (q *Quotas) save() error {
+	file := make(map[string]quotaUsage, len(q.usage))
+	for provider, usage := range q.usage {
+		saved := *usage
+		if quota, ok := q.quotas[provider]; ok {
+			saved.Used = max(min(usage.Used+QUOTA_RESERVE, quota.Limit), usage.Used)
+		}
+		file[provider] = saved
+	}
+	if err := writeQuotaFile(q.path, file); err != nil {
+		return err
+	}
+	for provider, usage := range file {
+		q.saved[provider] = usage.Used
+	}
+	return nil
+}
+
+// Close writes the exact usage to the file.
+func (q *Quotas) Close() error {
+	if q == nil {
+		return nil
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	file := make(map[string]quotaUsage, len(q.usage))
+	for provider, usage := range q.usage {
+		file[provider] = *usage
+	}
+	return writeQuotaFile(q.path, file)
+}
+
+// writeQuotaFile replaces the file at once, so that it is never
+// left half written.
+func writeQuotaFile(path string, usage map[string]quotaUsage) error {
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// WithQuotas counts requests of the job against the quotas, the job
+// stops with an error wrapping ErrQuotaExceeded when a quota is used
+// up. Tiles downloaded before are kept, so a job with a journal can be
+// resumed in the next period.
+func WithQuotas(q *Quotas) Option {
+	return func(o *options) {
+		o.quotas = q
+	}
+}
+
+// EstimateTiles returns the number of tiles the job would request
+// with the options, not counting tiles stored according to the journal
+// given with WithJournal.
+func EstimateTiles(mapDesc MapDescription, params DownloadParams, opts ...Option) (int, error) {
+	o := newOptions(opts)
+	if err := checkInput(mapDesc, params, o.registry); err != nil {
+		return 0, err
+	}
+	tiles, err := newJobTiles(mapDesc, params, o.registry)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	err = tiles.each(func(num geography.TileNum, _ []int) bool {
+		if o.journal == nil || o.journal.State(num.Z, num.X, num.Y) < TILE_STORED {
+			n++
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,141 @@
+package mapget
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+	"github.com/PlaceDescriber/PlaceDescriber/types"
+)
+
+func TestQuotas(t *testing.T) {
+	const LIMIT = 5
+	dir := t.TempDir()
+	path := filepath.Join(dir, "quotas.json")
+	mapDesc := initMapDescription()
+	// A single worker takes tiles in order.
+	params := DownloadParams{
+		GoroutinesNum: 1,
+		TryTimes:      TRY_TIMES,
+	}
+	total, err := EstimateTiles(mapDesc, params)
+	if err != nil || total <= LIMIT {
+		t.Fatalf("Quotas: EstimateTiles returned %d, %v.", total, err)
+	}
+	quotaList := []Quota{{Provider: mapDesc.Provider, Limit: LIMIT, Period: QUOTA_DAY}}
+	quotas, err := OpenQuotas(path, quotaList)
+	if err != nil {
+		t.Fatalf("Quotas: OpenQuotas failed: %v.", err)
+	}
+	journal, err := CreateJournal(filepath.Join(dir, "job.journal"), JobDefinition{ID: "test"})
+	if err != nil {
+		t.Fatalf("Quotas: CreateJournal failed: %v.", err)
+	}
+	defer journal.Close()
+	cache, err := OpenDiskCache(filepath.Join(dir, "cache"), CacheParams{})
+	if err != nil {
+		t.Fatalf("Quotas: OpenDiskCache failed: %v.", err)
+	}
+	client := Chain(newTestLoader(0, 0), cache.Middleware())
+	summary, err := DownloadToStore(context.Background(), mapDesc, params, DirStore{Path: filepath.Join(dir, "tiles")},
+		WithLoader(client), WithJournal(journal), WithQuotas(quotas))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("Quotas: got %v, want ErrQuotaExceeded.", err)
+	}
+	if summary.Outcomes[OUTCOME_DOWNLOADED] != LIMIT {
+		t.Errorf("Quotas: %d tiles downloaded with quota of %d.", summary.Outcomes[OUTCOME_DOWNLOADED], LIMIT)
+	}
+	// The rest of the job is left for the next day.
+	if left, err := EstimateTiles(mapDesc, params, WithJournal(journal)); err != nil || left != total-LIMIT {
+		t.Errorf("Quotas: %d tiles left of %d, %v.", left, total, err)
+	}
+	if err := quotas.Close(); err != nil {
+		t.Fatalf("Quotas: Close failed: %v.", err)
+	}
+
+	quotas, err = OpenQuotas(path, quotaList)
+	if err != nil {
+		t.Fatalf("Quotas: OpenQuotas failed: %v.", err)
+	}
+	if left, ok := quotas.Remaining(mapDesc.Provider); !ok || left != 0 {
+		t.Errorf("Quotas: %d left after reopening.", left)
+	}
+	if _, ok := quotas.Remaining("other"); ok {
+		t.Errorf("Quotas: provider without quota has one.")
+	}
+	quotas.now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+	if left, _ := quotas.Remaining(mapDesc.Provider); left != LIMIT {
+		t.Errorf("Quotas: %d left the next day.", left)
+	}
+	// Tiles from the cache are not counted.
+	summary, err = DownloadToStore(context.Background(), mapDesc, params, DirStore{Path: filepath.Join(dir, "again")},
+		WithLoader(client), WithQuotas(quotas))
+	if !errors.Is(err, ErrQuotaExceeded) || summary.Outcomes[OUTCOME_CACHED] != LIMIT || summary.Outcomes[OUTCOME_DOWNLOADED] != LIMIT {
+		t.Errorf("Quotas: got %v and %v with the cache.", summary.Outcomes, err)
+	}
+	// Tiles from the cache are served after the quota is used up.
+	if left, _ := quotas.Remaining(mapDesc.Provider); left != 0 {
+		t.Fatalf("Quotas: %d left, want 0.", left)
+	}
+	// The loader would serve the rest, it is not asked for them.
+	var requests int32
+	counted := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		atomic.AddInt32(&requests, 1)
+		return client.Do(ctx, url)
+	})
+	summary, err = DownloadToStore(context.Background(), mapDesc, params, DirStore{Path: filepath.Join(dir, "cached")},
+		WithLoader(counted), WithQuotas(quotas), WithCache(cache))
+	if !errors.Is(err, ErrQuotaExceeded) || summary.Outcomes[OUTCOME_CACHED] != 2*LIMIT || summary.Outcomes[OUTCOME_DOWNLOADED] != 0 {
+		t.Errorf("Quotas: got %v and %v from the cache with the used up quota.", summary.Outcomes, err)
+	}
+	if requests != 0 {
+		t.Errorf("Quotas: %d requests to the loader with the used up quota.", requests)
+	}
+}
+
+func TestQuotaFallbacks(t *testing.T) {
+	registry := NewRegistry(MapProjects)
+	for _, name := range []string{"primary", "backup"} {
+		registry.Register(name, TemplateMaps{
+			URLs:       TypeToUrl{types.PLAN: name + "/{z}/{x}/{y}"},
+			Conversion: geography.EllipticalConversion{},
+		})
+	}
+	client := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(url)), nil
+	})
+	mapDesc := initMapDescription()
+	mapDesc.Type = types.PLAN
+	mapDesc.Provider = "primary"
+	mapDesc.Fallbacks = []string{"backup"}
+	params := DownloadParams{
+		GoroutinesNum: 1,
+		TryTimes:      TRY_TIMES,
+	}
+	quotas, err := OpenQuotas(filepath.Join(t.TempDir(), "quotas.json"), []Quota{
+		{Provider: "primary", Limit: 2, Period: QUOTA_DAY},
+		{Provider: "backup", Limit: 3, Period: QUOTA_DAY},
+	})
+	if err != nil {
+		t.Fatalf("QuotaFallbacks: OpenQuotas failed: %v.", err)
+	}
+	it := Download(context.Background(), mapDesc, params, WithLoader(client), WithRegistry(registry), WithQuotas(quotas))
+	providers := make(map[string]int)
+	for it.Next() {
+		providers[it.Tile().Provider]++
+	}
+	// The job stops when the quotas of all providers are used up.
+	if !errors.Is(it.Err(), ErrQuotaExceeded) {
+		t.Errorf("QuotaFallbacks: got %v, want ErrQuotaExceeded.", it.Err())
+	}
+	if providers["primary"] != 2 || providers["backup"] != 3 {
+		t.Errorf("QuotaFallbacks: got tiles of %v.", providers)
+	}
+}
@@ -0,0 +1,59 @@
+package mapget
+
+// registry.go: providers available to downloads.
+
+import (
+	"sort"
+	"sync"
+)
+
+// Registry is a set of providers by name, safe for concurrent use.
+// Downloads use the registry given with WithRegistry, or a copy of
+// MapProjects made when they start.
+type Registry struct {
+	mtx      sync.RWMutex
+	projects map[string]MapProject
+}
+
+// NewRegistry returns the registry with a copy of the providers.
+func NewRegistry(projects map[string]MapProject) *Registry {
+	r := &Registry{projects: make(map[string]MapProject, len(projects))}
+	for name, project := range projects {
+		r.projects[name] = project
+	}
+	return r
+}
+
+// Register adds the provider, replacing the one with the same name.
+func (r *Registry) Register(name string, project MapProject) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.projects[name] = project
+}
+
+// Lookup returns the provider with the name.
+func (r *Registry) Lookup(name string) (MapProject, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	project, ok := r.projects[name]
+	return project, ok
+}
+
+// List returns the sorted names of the providers.
+func (r *Registry) List() []string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	names := make([]string, 0, len(r.projects))
+	for name := range r.projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithRegistry makes the download take providers from r.
+func WithRegistry(r *Registry) Option {
+	return func(o *options) {
+		o.registry = r
+	}
+}
@@ -0,0 +1,59 @@
+package mapget
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+	"github.com/PlaceDescriber/PlaceDescriber/types"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry(MapProjects)
+	project := TemplateMaps{
+		URLs:       TypeToUrl{types.PLAN: "http://isolated/{z}/{x}/{y}"},
+		Conversion: geography.EllipticalConversion{},
+	}
+	registry.Register("isolated", project)
+	if _, ok := registry.Lookup("isolated"); !ok {
+		t.Errorf("Registry: registered provider is not found.")
+	}
+	if _, ok := MapProjects["isolated"]; ok {
+		t.Errorf("Registry: provider leaked to MapProjects.")
+	}
+	if names := registry.List(); len(names) != 2 || names[0] != "isolated" || names[1] != "yandex" {
+		t.Errorf("Registry: List returned %v.", names)
+	}
+
+	mapDesc := initMapDescription()
+	mapDesc.Provider = "isolated"
+	mapDesc.MaxZoom = 16
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	// Providers are registered while the download runs.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			registry.Register(fmt.Sprintf("other%d", i), project)
+		}
+	}()
+	summary, err := DownloadToStore(context.Background(), mapDesc, params, DirStore{Path: t.TempDir()},
+		WithLoader(newTestLoader(0, 0)), WithRegistry(registry))
+	wg.Wait()
+	if err != nil || summary.Done == 0 {
+		t.Errorf("Registry: download got %+v, %v.", summary, err)
+	}
+	if _, err := DownloadToStore(context.Background(), mapDesc, params, DirStore{Path: t.TempDir()},
+		WithLoader(newTestLoader(0, 0))); err == nil {
+		t.Errorf("Registry: provider of the registry is used by default.")
+	}
+	if len(registry.List()) != 102 {
+		t.Errorf("Registry: got %d providers.", len(registry.List()))
+	}
+}
@@ -0,0 +1,145 @@
+package mapget
+
+// replay.go: recording of HTTP sessions and their offline replay.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ErrNotRecorded is returned by ReplayLoader for unknown URLs.
+var ErrNotRecorded = errors.New("not in the recording")
+
+// Exchange is a single recorded response. A recording is a file
+// of exchanges, one JSON object per line.
+type Exchange struct {
+	URL    string      `json:"url"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// Recorder is an http.RoundTripper saving every response it passes.
+// Use it as Transport of DefaultLoader.Client.
+type Recorder struct {
+	next http.RoundTripper
+
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+// NewRecorder writes responses of next to w,
+// http.DefaultTransport is used if next is nil.
+func NewRecorder(w io.Writer, next http.RoundTripper) *Recorder {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Recorder{next: next, w: w}
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := r.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	line, err := json.Marshal(Exchange{
+		URL:    req.URL.String(),
+		Status: res.StatusCode,
+		Header: res.Header,
+		Body:   body,
+	})
+	if err != nil {
+		return nil, err
+	}
+	r.mtx.Lock()
+	_, err = r.w.Write(append(line, '\n'))
+	r.mtx.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("Recorder: %v", err)
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return res, nil
+}
+
+// ReplayLoader serves responses from a recording. Responses recorded
+// for the same URL several times are replayed in the recorded order,
+// the last one is repeated after that.
+type ReplayLoader struct {
+	mtx       sync.Mutex
+	exchanges map[string][]*Exchange
+	missing   map[string]bool
+}
+
+// OpenReplay reads the recording from r.
+func OpenReplay(r io.Reader) (*ReplayLoader, error) {
+	l := &ReplayLoader{
+		exchanges: make(map[string][]*Exchange),
+		missing:   make(map[string]bool),
+	}
+	scanner := bufio.NewScanner(r)
+	// Bodies of satellite tiles don't fit the default limit.
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		exchange := &Exchange{}
+		if err := json.Unmarshal(scanner.Bytes(), exchange); err != nil {
+			return nil, fmt.Errorf("recording line %d: %v", line, err)
+		}
+		l.exchanges[exchange.URL] = append(l.exchanges[exchange.URL], exchange)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *ReplayLoader) Do(ctx context.Context, url string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	l.mtx.Lock()
+	exchanges := l.exchanges[url]
+	if len(exchanges) == 0 {
+		l.missing[url] = true
+		l.mtx.Unlock()
+		return nil, fmt.Errorf("%s: %w", url, ErrNotRecorded)
+	}
+	exchange := exchanges[0]
+	if len(exchanges) > 1 {
+		l.exchanges[url] = exchanges[1:]
+	}
+	l.mtx.Unlock()
+	if exchange.Status != http.StatusOK {
+		return nil, &HTTPError{
+			URL:        url,
+			StatusCode: exchange.Status,
+			RetryAfter: parseRetryAfter(exchange.Header.Get("Retry-After")),
+		}
+	}
+	return ioutil.NopCloser(bytes.NewReader(exchange.Body)), nil
+}
+
+// Missing returns the requested URLs that were not recorded.
+func (l *ReplayLoader) Missing() []string {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	urls := make([]string, 0, len(l.missing))
+	for url := range l.missing {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	return urls
+}
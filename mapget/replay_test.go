@@ -0,0 +1,79 @@
+package mapget
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+	"github.com/PlaceDescriber/PlaceDescriber/mapget/tiletest"
+)
+
+func TestRecordReplay(t *testing.T) {
+	server := tiletest.NewServer(tiletest.Params{ErrorRate: 0.1, Seed: 1})
+	defer server.Close()
+	registry := serveProvider("tiletest", server)
+	mapDesc := initMapDescription()
+	mapDesc.Provider = "tiletest"
+	mapDesc.MaxZoom = 16
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	download := func(client Loader) map[string][]byte {
+		var wg sync.WaitGroup
+		var err error
+		tiles := make(map[string][]byte)
+		out := make(chan *geography.MapTile)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err = DownloadMap(context.Background(), params, mapDesc, out, client, WithRegistry(registry))
+		}()
+		for tile := range out {
+			mapProj, _ := registry.Lookup(tile.Provider)
+			url, _ := mapProj.GetURL(tile.X, tile.Y, tile.Z, mapDesc.Scale, tile.Language, tile.Type)
+			tiles[url] = tile.Content
+		}
+		wg.Wait()
+		if err != nil {
+			t.Fatalf("RecordReplay: DownloadMap failed: %v.", err)
+		}
+		return tiles
+	}
+
+	var recording bytes.Buffer
+	recorder := NewRecorder(&recording, nil)
+	recorded := download(DefaultLoader{Client: &http.Client{Transport: recorder}})
+	requests := server.Requests(http.StatusOK) + server.Requests(http.StatusInternalServerError)
+	server.Close()
+
+	replay, err := OpenReplay(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatalf("RecordReplay: OpenReplay failed: %v.", err)
+	}
+	replayed := download(replay)
+	if len(replayed) != len(recorded) {
+		t.Fatalf("RecordReplay: replayed %d tiles, recorded %d.", len(replayed), len(recorded))
+	}
+	for url, content := range recorded {
+		if !bytes.Equal(replayed[url], content) {
+			t.Errorf("RecordReplay: tile %s differs.", url)
+		}
+	}
+	if n := bytes.Count(recording.Bytes(), []byte("\n")); n != requests {
+		t.Errorf("RecordReplay: recorded %d responses of %d.", n, requests)
+	}
+	if missing := replay.Missing(); len(missing) != 0 {
+		t.Errorf("RecordReplay: missing URLs %v.", missing)
+	}
+	if _, err := replay.Do(context.Background(), "http://unknown"); !errors.Is(err, ErrNotRecorded) {
+		t.Errorf("RecordReplay: unknown URL returned %v.", err)
+	}
+	if missing := replay.Missing(); len(missing) != 1 || missing[0] != "http://unknown" {
+		t.Errorf("RecordReplay: missing URLs %v, want the unknown one.", missing)
+	}
+}
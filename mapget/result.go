@@ -0,0 +1,71 @@
+package mapget
+
+// result.go: outcomes of single tiles.
+
+import (
+	"sync"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+type Outcome int
+
+const (
+	// OUTCOME_DOWNLOADED tiles came from the provider.
+	OUTCOME_DOWNLOADED Outcome = iota
+	// OUTCOME_CACHED tiles came from DiskCache.
+	OUTCOME_CACHED
+	// OUTCOME_UNCHANGED tiles are stored according to the journal
+	// and were not requested.
+	OUTCOME_UNCHANGED
+	// OUTCOME_EMPTY tiles have no content, the provider answered
+	// with an empty body or 204 No Content. They are not sent to out.
+	OUTCOME_EMPTY
+	// OUTCOME_FAILED tiles failed all attempts.
+	OUTCOME_FAILED
+	// OUTCOME_CANCELLED tiles were left undone when the job stopped,
+	// e.g. after a failure, a cancellation or a used up quota.
+	OUTCOME_CANCELLED
+)
+
+var OutcomeToStr = map[Outcome]string{
+	OUTCOME_DOWNLOADED: "downloaded",
+	OUTCOME_CACHED:     "cached",
+	OUTCOME_UNCHANGED:  "unchanged",
+	OUTCOME_EMPTY:      "empty",
+	OUTCOME_FAILED:     "failed",
+	OUTCOME_CANCELLED:  "cancelled",
+}
+
+func (o Outcome) String() string {
+	return OutcomeToStr[o]
+}
+
+// Result is the outcome of a single tile.
+type Result struct {
+	Tile    *geography.MapTile
+	Outcome Outcome
+	// Err is a *TileError for failed tiles.
+	Err error
+}
+
+// WithResults makes the job call f with the result of every tile of
+// the map, tiles the job didn't get to are reported as cancelled.
+// Tiles are passed to f after they are sent to out. Calls are serialized.
+func WithResults(f func(Result)) Option {
+	var mtx sync.Mutex
+	return func(o *options) {
+		o.results = func(r Result) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			f(r)
+		}
+	}
+}
+
+// result reports the result if asked to.
+func (j *Job) result(tile *geography.MapTile, outcome Outcome, err error) {
+	if j.opts.results != nil {
+		j.opts.results(Result{Tile: tile, Outcome: outcome, Err: err})
+	}
+}
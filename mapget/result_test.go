@@ -0,0 +1,134 @@
+package mapget
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+// collectResults downloads the test map and counts outcomes of tiles.
+func collectResults(t *testing.T, client Loader, opts ...Option) (map[Outcome]int, []Result, error) {
+	counts := make(map[Outcome]int)
+	var results []Result
+	opts = append(opts, WithResults(func(r Result) {
+		counts[r.Outcome]++
+		results = append(results, r)
+	}))
+	out := make(chan *geography.MapTile)
+	params := DownloadParams{
+		GoroutinesNum: GOROUTINES_NUMBER,
+		TryTimes:      TRY_TIMES,
+	}
+	job := StartJob(context.Background(), params, initMapDescription(), out, client, opts...)
+	sent := 0
+	for tile := range out {
+		if len(tile.Content) == 0 {
+			t.Errorf("Results: empty tile %d/%d/%d was sent.", tile.Z, tile.X, tile.Y)
+		}
+		sent++
+	}
+	err := job.Wait()
+	if sent != counts[OUTCOME_DOWNLOADED]+counts[OUTCOME_CACHED] {
+		t.Errorf("Results: %d tiles sent, results are %v.", sent, counts)
+	}
+	return counts, results, err
+}
+
+func TestResults(t *testing.T) {
+	var mtx sync.Mutex
+	calls := 0
+	// The first tile is 204 No Content, the second one is empty.
+	provider := LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+		mtx.Lock()
+		calls++
+		call := calls
+		mtx.Unlock()
+		switch call {
+		case 1:
+			return nil, &HTTPError{URL: url, StatusCode: http.StatusNoContent}
+		case 2:
+			return ioutil.NopCloser(&bytes.Buffer{}), nil
+		}
+		return ioutil.NopCloser(strings.NewReader(url)), nil
+	})
+	cache, err := OpenDiskCache(t.TempDir(), CacheParams{})
+	if err != nil {
+		t.Fatalf("Results: OpenDiskCache failed: %v.", err)
+	}
+	// Bodies of the cache are wrapped, it must not hide cache hits.
+	wrap := func(next Loader) Loader {
+		return LoaderFunc(func(ctx context.Context, url string) (io.ReadCloser, error) {
+			body, err := next.Do(ctx, url)
+			if err != nil {
+				return nil, err
+			}
+			return struct{ io.ReadCloser }{body}, nil
+		})
+	}
+	client := Chain(provider, wrap, cache.Middleware())
+	counts, results, err := collectResults(t, client)
+	if err != nil {
+		t.Fatalf("Results: download failed: %v.", err)
+	}
+	total := len(results)
+	if counts[OUTCOME_EMPTY] != 2 || counts[OUTCOME_DOWNLOADED] != total-2 {
+		t.Errorf("Results: got %v of %d tiles, want 2 empty.", counts, total)
+	}
+	// Everything but 204 is cached now, it has content this time.
+	counts, _, err = collectResults(t, client)
+	if err != nil {
+		t.Fatalf("Results: download failed: %v.", err)
+	}
+	if counts[OUTCOME_CACHED] != total-2 || counts[OUTCOME_EMPTY] != 1 || counts[OUTCOME_DOWNLOADED] != 1 {
+		t.Errorf("Results: got %v of %d tiles from the cache.", counts, total)
+	}
+
+	journal, err := CreateJournal(filepath.Join(t.TempDir(), "job.journal"), JobDefinition{ID: "test"})
+	if err != nil {
+		t.Fatalf("Results: CreateJournal failed: %v.", err)
+	}
+	defer journal.Close()
+	// Mark the first tile as stored, it is skipped
+	// before the job fails.
+	stored := results[0].Tile
+	for _, r := range results {
+		tile := r.Tile
+		if tile.Z < stored.Z || tile.Z == stored.Z && (tile.X < stored.X || tile.X == stored.X && tile.Y < stored.Y) {
+			stored = tile
+		}
+	}
+	journal.Record(stored.Z, stored.X, stored.Y, TILE_STORED)
+	counts, results, err = collectResults(t, newTestLoader(total, TRY_TIMES), WithJournal(journal))
+	var tileErr *TileError
+	if !errors.As(err, &tileErr) {
+		t.Fatalf("Results: got %v, want TileError.", err)
+	}
+	if counts[OUTCOME_UNCHANGED] != 1 || counts[OUTCOME_FAILED] == 0 {
+		t.Errorf("Results: got %v with a stored tile and failures.", counts)
+	}
+	// Tiles left after the first failure are cancelled.
+	if len(results) != total || counts[OUTCOME_CANCELLED] == 0 {
+		t.Errorf("Results: got %v of %d tiles after a failure.", counts, total)
+	}
+	for _, r := range results {
+		switch r.Outcome {
+		case OUTCOME_UNCHANGED:
+			if r.Tile.Z != stored.Z || r.Tile.X != stored.X || r.Tile.Y != stored.Y {
+				t.Errorf("Results: tile %d/%d/%d is unchanged.", r.Tile.Z, r.Tile.X, r.Tile.Y)
+			}
+		case OUTCOME_FAILED:
+			if !errors.As(r.Err, &tileErr) || tileErr.Z != r.Tile.Z || tileErr.X != r.Tile.X {
+				t.Errorf("Results: failed tile has error %v.", r.Err)
+			}
+		}
+	}
+}
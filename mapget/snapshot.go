@@ -0,0 +1,242 @@
+package mapget
+
+// snapshot.go: comparison of maps downloaded at different times.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+type ChangeKind int
+
+const (
+	TILE_ADDED ChangeKind = iota
+	TILE_REMOVED
+	TILE_CHANGED
+)
+
+var ChangeKindToStr = map[ChangeKind]string{
+	TILE_ADDED:   "added",
+	TILE_REMOVED: "removed",
+	TILE_CHANGED: "changed",
+}
+
+func (k ChangeKind) String() string {
+	return ChangeKindToStr[k]
+}
+
+// TileChange is a difference between two snapshots.
+type TileChange struct {
+	Z    int
+	X    int
+	Y    int
+	Kind ChangeKind
+	// Difference of changed tiles is the mean difference of
+	// pixels from 0 to 1, it is 1 if they can't be compared.
+	Difference float64
+}
+
+// readSnapshot lists tiles of the snapshot in path/z/x/y files,
+// other files are ignored.
+func readSnapshot(path string) (map[tileKey]string, error) {
+	files, err := filepath.Glob(filepath.Join(path, "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	tiles := make(map[tileKey]string)
+	for _, file := range files {
+		y, err := strconv.Atoi(filepath.Base(file))
+		if err != nil {
+			continue
+		}
+		x, err := strconv.Atoi(filepath.Base(filepath.Dir(file)))
+		if err != nil {
+			continue
+		}
+		z, err := strconv.Atoi(filepath.Base(filepath.Dir(filepath.Dir(file))))
+		if err != nil {
+			continue
+		}
+		tiles[tileKey{z, x, y}] = file
+	}
+	return tiles, nil
+}
+
+func hashFile(path string) ([sha256.Size]byte, []byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, nil, err
+	}
+	return sha256.Sum256(content), content, nil
+}
+
+// imageDifference returns the mean difference of pixels of two images,
+// images of different sizes or undecodable ones differ completely.
+func imageDifference(a, b []byte) float64 {
+	imgA, _, err := image.Decode(bytes.NewReader(a))
+	if err != nil {
+		return 1
+	}
+	imgB, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return 1
+	}
+	boundsA, boundsB := imgA.Bounds(), imgB.Bounds()
+	if boundsA.Dx() != boundsB.Dx() || boundsA.Dy() != boundsB.Dy() || boundsA.Empty() {
+		return 1
+	}
+	var sum float64
+	for y := 0; y < boundsA.Dy(); y++ {
+		for x := 0; x < boundsA.Dx(); x++ {
+			r0, g0, b0, a0 := imgA.At(boundsA.Min.X+x, boundsA.Min.Y+y).RGBA()
+			r1, g1, b1, a1 := imgB.At(boundsB.Min.X+x, boundsB.Min.Y+y).RGBA()
+			sum += absDiff(r0, r1) + absDiff(g0, g1) + absDiff(b0, b1) + absDiff(a0, a1)
+		}
+	}
+	return sum / (4 * 0xffff * float64(boundsA.Dx()*boundsA.Dy()))
+}
+
+func absDiff(a, b uint32) float64 {
+	if a > b {
+		return float64(a - b)
+	}
+	return float64(b - a)
+}
+
+// DiffSnapshots compares tiles of two snapshots in oldPath and newPath.
+// Tiles with different bytes are changed if their difference is at
+// least threshold, zero threshold compares bytes only. Changes are
+// sorted by z, x and y.
+func DiffSnapshots(oldPath, newPath string, threshold float64) ([]TileChange, error) {
+	if threshold < 0 || threshold > 1 {
+		return nil, fmt.Errorf("Threshold is out of range: %g", threshold)
+	}
+	for _, path := range []string{oldPath, newPath} {
+		if stat, err := os.Stat(path); err != nil {
+			return nil, err
+		} else if !stat.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", path)
+		}
+	}
+	oldTiles, err := readSnapshot(oldPath)
+	if err != nil {
+		return nil, err
+	}
+	newTiles, err := readSnapshot(newPath)
+	if err != nil {
+		return nil, err
+	}
+	var changes []TileChange
+	for key, newFile := range newTiles {
+		oldFile, ok := oldTiles[key]
+		if !ok {
+			changes = append(changes, TileChange{Z: key.Z, X: key.X, Y: key.Y, Kind: TILE_ADDED})
+			continue
+		}
+		oldHash, oldContent, err := hashFile(oldFile)
+		if err != nil {
+			return nil, err
+		}
+		newHash, newContent, err := hashFile(newFile)
+		if err != nil {
+			return nil, err
+		}
+		if oldHash == newHash {
+			continue
+		}
+		difference := 1.0
+		if threshold > 0 {
+			difference = imageDifference(oldContent, newContent)
+			if difference < threshold {
+				continue
+			}
+		}
+		changes = append(changes, TileChange{
+			Z:          key.Z,
+			X:          key.X,
+			Y:          key.Y,
+			Kind:       TILE_CHANGED,
+			Difference: difference,
+		})
+	}
+	for key := range oldTiles {
+		if _, ok := newTiles[key]; !ok {
+			changes = append(changes, TileChange{Z: key.Z, X: key.X, Y: key.Y, Kind: TILE_REMOVED})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		if a.Z != b.Z {
+			return a.Z < b.Z
+		}
+		if a.X != b.X {
+			return a.X < b.X
+		}
+		return a.Y < b.Y
+	})
+	return changes, nil
+}
+
+type geoJSONGeometry struct {
+	Type        string         `json:"type"`
+	Coordinates [][][2]float64 `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// ChangesGeoJSON returns a GeoJSON FeatureCollection of footprints
+// of changed tiles, the converter must be the one of the provider.
+func ChangesGeoJSON(changes []TileChange, converter geography.Conversion) ([]byte, error) {
+	collection := geoJSONCollection{
+		Type:     "FeatureCollection",
+		Features: make([]geoJSONFeature, 0, len(changes)),
+	}
+	for _, change := range changes {
+		nw := converter.TileNumToDeg(change.X, change.Y, change.Z)
+		se := converter.TileNumToDeg(change.X+1, change.Y+1, change.Z)
+		// GeoJSON has longitude first and outer rings counterclockwise.
+		ring := [][2]float64{
+			{nw.Longitude, se.Latitude},
+			{se.Longitude, se.Latitude},
+			{se.Longitude, nw.Latitude},
+			{nw.Longitude, nw.Latitude},
+			{nw.Longitude, se.Latitude},
+		}
+		properties := map[string]interface{}{
+			"z":      change.Z,
+			"x":      change.X,
+			"y":      change.Y,
+			"change": change.Kind.String(),
+		}
+		if change.Kind == TILE_CHANGED {
+			properties["difference"] = change.Difference
+		}
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:       "Feature",
+			Geometry:   geoJSONGeometry{Type: "Polygon", Coordinates: [][][2]float64{ring}},
+			Properties: properties,
+		})
+	}
+	return json.MarshalIndent(collection, "", "  ")
+}
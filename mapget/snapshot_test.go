@@ -0,0 +1,103 @@
+package mapget
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+// grayTile returns a PNG tile of the gray level with the given
+// number of white pixels.
+func grayTile(level uint8, white int) []byte {
+	img := image.NewGray(image.Rect(0, 0, TILE_SIZE, TILE_SIZE))
+	for i := range img.Pix {
+		img.Pix[i] = level
+		if i < white {
+			img.Pix[i] = 0xff
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func writeSnapshot(t *testing.T, tiles map[tileKey][]byte) string {
+	path := t.TempDir()
+	for key, content := range tiles {
+		dir := filepath.Join(path, strconv.Itoa(key.Z), strconv.Itoa(key.X))
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, strconv.Itoa(key.Y)), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	oldPath := writeSnapshot(t, map[tileKey][]byte{
+		{1, 0, 0}: grayTile(0x80, 0),
+		{1, 0, 1}: grayTile(0x80, 0),
+		{1, 1, 0}: grayTile(0x80, 0),
+		{1, 1, 1}: grayTile(0x80, 0),
+	})
+	newPath := writeSnapshot(t, map[tileKey][]byte{
+		{1, 0, 1}: grayTile(0x80, 0),
+		{1, 1, 0}: grayTile(0x80, 10),
+		{1, 1, 1}: grayTile(0, 0),
+		{2, 0, 0}: grayTile(0x80, 0),
+	})
+	// Partial downloads are not tiles.
+	ioutil.WriteFile(filepath.Join(newPath, "1", "0", "0.123.tmp"), nil, 0600)
+	changes, err := DiffSnapshots(oldPath, newPath, 0)
+	if err != nil {
+		t.Fatalf("DiffSnapshots failed: %v.", err)
+	}
+	want := []TileChange{
+		{Z: 1, X: 0, Y: 0, Kind: TILE_REMOVED},
+		{Z: 1, X: 1, Y: 0, Kind: TILE_CHANGED, Difference: 1},
+		{Z: 1, X: 1, Y: 1, Kind: TILE_CHANGED, Difference: 1},
+		{Z: 2, X: 0, Y: 0, Kind: TILE_ADDED},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("DiffSnapshots: got %v, want %v.", changes, want)
+	}
+	for i := range want {
+		if changes[i] != want[i] {
+			t.Errorf("DiffSnapshots: got %v, want %v.", changes[i], want[i])
+		}
+	}
+	// A few changed pixels are below the threshold.
+	changes, err = DiffSnapshots(oldPath, newPath, 0.01)
+	if err != nil {
+		t.Fatalf("DiffSnapshots failed: %v.", err)
+	}
+	if len(changes) != 3 || changes[1].X != 1 || changes[1].Y != 1 || changes[1].Difference < 0.3 {
+		t.Errorf("DiffSnapshots: got %v with threshold.", changes)
+	}
+	data, err := ChangesGeoJSON(changes, geography.SphericalConversion{})
+	if err != nil {
+		t.Fatalf("ChangesGeoJSON failed: %v.", err)
+	}
+	var collection geoJSONCollection
+	if err := json.Unmarshal(data, &collection); err != nil {
+		t.Fatalf("ChangesGeoJSON: bad JSON: %v.", err)
+	}
+	if len(collection.Features) != 3 {
+		t.Fatalf("ChangesGeoJSON: got %d features, want 3.", len(collection.Features))
+	}
+	// The north-west quarter of the world.
+	ring := collection.Features[0].Geometry.Coordinates[0]
+	if ring[0][0] != -180 || ring[0][1] != 0 || ring[1][0] != 0 || ring[2][1] < 85 {
+		t.Errorf("ChangesGeoJSON: wrong footprint %v.", ring)
+	}
+}
@@ -0,0 +1,178 @@
+package mapget
+
+// store.go: streaming of tiles to storage and accounting
+// of bytes held by workers.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+// Bodies are read in chunks of at most READ_CHUNK bytes.
+const READ_CHUNK = 32 << 10
+
+// Store saves tiles as they are downloaded.
+type Store interface {
+	// Put saves content of the tile. It is called again for the
+	// same tile if reading of the content fails.
+	Put(ctx context.Context, tile *geography.MapTile, content io.Reader) error
+}
+
+// WithStore makes workers write tiles straight to the store instead
+// of reading them into MapTile.Content. Tiles sent to out have no
+// content then. Stored tiles are recorded in the journal if any.
+func WithStore(s Store) Option {
+	return func(o *options) {
+		o.store = s
+	}
+}
+
+// DirStore keeps tiles in Path/z/x/y files.
+type DirStore struct {
+	Path string
+}
+
+func (s DirStore) Put(ctx context.Context, tile *geography.MapTile, content io.Reader) error {
+	dir := filepath.Join(s.Path, fmt.Sprint(tile.Z), fmt.Sprint(tile.X))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a failed
+	// download doesn't leave a partial tile.
+	tmp, err := ioutil.TempFile(dir, fmt.Sprintf("%d.*.tmp", tile.Y))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, content)
+	if err1 := tmp.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, fmt.Sprint(tile.Y)))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// byteBudget limits the number of bytes held by workers. A nil
+// *byteBudget is unlimited.
+type byteBudget struct {
+	mtx      sync.Mutex
+	capacity int64
+	used     int64
+	// wake is closed and replaced every time bytes are released.
+	wake chan struct{}
+}
+
+func newByteBudget(capacity int64) *byteBudget {
+	if capacity <= 0 {
+		return nil
+	}
+	return &byteBudget{capacity: capacity, wake: make(chan struct{})}
+}
+
+// acquire blocks until n bytes fit the budget. More than the capacity
+// is given only when nothing else is held, so that it can't deadlock.
+func (b *byteBudget) acquire(ctx context.Context, n int64) error {
+	if b == nil {
+		return nil
+	}
+	for {
+		b.mtx.Lock()
+		if b.used == 0 || b.used+n <= b.capacity {
+			b.used += n
+			b.mtx.Unlock()
+			return nil
+		}
+		wake := b.wake
+		b.mtx.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+func (b *byteBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mtx.Lock()
+	b.used -= n
+	close(b.wake)
+	b.wake = make(chan struct{})
+	b.mtx.Unlock()
+}
+
+// inUse returns the number of bytes held.
+func (b *byteBudget) inUse() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.used
+}
+
+// take adds n bytes to the budget without waiting.
+func (b *byteBudget) take(n int64) {
+	if b == nil {
+		return
+	}
+	b.mtx.Lock()
+	b.used += n
+	b.mtx.Unlock()
+}
+
+// budgetReader takes bytes it reads from the budget. Without keep
+// a chunk is released on the next Read, as it has been consumed by
+// then; with keep the bytes stay held until the caller releases them.
+// Only the first chunk of kept content waits for the budget: readers
+// holding a part of a body and waiting for each other would deadlock,
+// so a started body is always read to the end.
+type budgetReader struct {
+	ctx    context.Context
+	r      io.Reader
+	budget *byteBudget
+	keep   bool
+	// held is what was taken from the budget, read is all
+	// bytes read.
+	held int64
+	read int64
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	if !r.keep {
+		r.budget.release(r.held)
+		r.held = 0
+	}
+	if len(p) > READ_CHUNK {
+		p = p[:READ_CHUNK]
+	}
+	if r.keep && r.held > 0 {
+		r.budget.take(int64(len(p)))
+	} else if err := r.budget.acquire(r.ctx, int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	r.budget.release(int64(len(p) - n))
+	r.held += int64(n)
+	r.read += int64(n)
+	return n, err
+}
+
+// close releases all bytes held.
+func (r *budgetReader) close() {
+	r.budget.release(r.held)
+	r.held = 0
+}
@@ -0,0 +1,135 @@
+package mapget
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+	"github.com/PlaceDescriber/PlaceDescriber/mapget/tiletest"
+)
+
+func TestByteBudget(t *testing.T) {
+	budget := newByteBudget(100)
+	ctx := context.Background()
+	budget.acquire(ctx, 60)
+	acquired := make(chan struct{})
+	go func() {
+		budget.acquire(ctx, 60)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("ByteBudget: acquired over the capacity.")
+	case <-time.After(50 * time.Millisecond):
+	}
+	budget.release(60)
+	<-acquired
+	budget.release(60)
+	// More than the capacity is given when nothing is held.
+	budget.acquire(ctx, 200)
+	budget.release(200)
+	if used := budget.inUse(); used != 0 {
+		t.Errorf("ByteBudget: %d bytes used after release.", used)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	var wg sync.WaitGroup
+	var err error
+	server := tiletest.NewServer(tiletest.Params{SlowBody: 5 * time.Millisecond})
+	defer server.Close()
+	registry := serveProvider("tiletest", server)
+	mapDesc := initMapDescription()
+	mapDesc.Provider = "tiletest"
+	mapDesc.MaxZoom = 16
+	params := DownloadParams{
+		GoroutinesNum:    GOROUTINES_NUMBER,
+		TryTimes:         TRY_TIMES,
+		MaxBytesInFlight: READ_CHUNK,
+	}
+	dir := t.TempDir()
+	journal, err := CreateJournal(filepath.Join(dir, "job.journal"), JobDefinition{ID: "test"})
+	if err != nil {
+		t.Fatalf("Streaming: CreateJournal failed: %v.", err)
+	}
+	defer journal.Close()
+	store := DirStore{Path: filepath.Join(dir, "tiles")}
+	out := make(chan *geography.MapTile)
+	job := StartJob(
+		context.Background(),
+		params,
+		mapDesc,
+		out,
+		DefaultLoader{},
+		WithStore(store),
+		WithJournal(journal),
+		WithRegistry(registry),
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = job.Wait()
+	}()
+	var tiles []*geography.MapTile
+	for tile := range out {
+		if tile.Content != nil {
+			t.Errorf("Streaming: tile %d/%d/%d has content.", tile.Z, tile.X, tile.Y)
+		}
+		if used := job.budget.inUse(); used > READ_CHUNK {
+			t.Errorf("Streaming: %d bytes held.", used)
+		}
+		tiles = append(tiles, tile)
+	}
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Streaming: DownloadMap failed: %v.", err)
+	}
+	for _, tile := range tiles {
+		content, err := ioutil.ReadFile(filepath.Join(store.Path, strconv.Itoa(tile.Z), strconv.Itoa(tile.X), strconv.Itoa(tile.Y)))
+		if err != nil {
+			t.Fatalf("Streaming: failed to read stored tile: %v.", err)
+		}
+		if !bytes.Equal(content, tiletest.Tile(tile.Z, tile.X, tile.Y)) {
+			t.Errorf("Streaming: tile %d/%d/%d was stored wrong.", tile.Z, tile.X, tile.Y)
+		}
+	}
+	if n := journal.Count(TILE_STORED); n != len(tiles) {
+		t.Errorf("Streaming: %d tiles recorded as stored, want %d.", n, len(tiles))
+	}
+}
+
+func TestBytesInFlight(t *testing.T) {
+	var wg sync.WaitGroup
+	var err error
+	out := make(chan *geography.MapTile)
+	params := DownloadParams{
+		GoroutinesNum:    GOROUTINES_NUMBER,
+		TryTimes:         TRY_TIMES,
+		MaxBytesInFlight: 200,
+	}
+	job := StartJob(context.Background(), params, initMapDescription(), out, newTestLoader(0, 0))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		err = job.Wait()
+	}()
+	for _ = range out {
+		// Workers finish the bodies they started above the cap.
+		if used := job.budget.inUse(); used > 200+GOROUTINES_NUMBER*READ_CHUNK {
+			t.Errorf("BytesInFlight: %d bytes held.", used)
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("BytesInFlight: DownloadMap failed: %v.", err)
+	}
+	if used := job.budget.inUse(); used != 0 {
+		t.Errorf("BytesInFlight: %d bytes held after the download.", used)
+	}
+}
@@ -0,0 +1,179 @@
+package mapget
+
+// tiles.go: tiles of jobs. They are generated a zoom level at a time,
+// so that maps of high zoom levels are never held in memory.
+
+import (
+	"fmt"
+
+	"github.com/PlaceDescriber/PlaceDescriber/geography"
+)
+
+// tileArea is tiles of a zoom level, a geography.TileRect
+// or a *geography.TileSet.
+type tileArea interface {
+	Contains(z, x, y int) bool
+	Len() int
+	Each(f func(tile geography.TileNum) bool)
+}
+
+// tiles returns the tiles of the layer at the zoom level.
+func (l AreaLayer) tiles(z int, converter geography.Conversion) (tileArea, error) {
+	if l.Route != nil {
+		return geography.CorridorTileSet(*l.Route, l.Buffer, z, z, converter)
+	}
+	return geography.PolygonTileRect(l.MapArea, z, converter)
+}
+
+// jobTiles are the tiles of the shard of a job.
+type jobTiles struct {
+	converter geography.Conversion
+	// layers are the layers of the map, or its own area
+	// if it has none.
+	layers []AreaLayer
+	named  bool
+	// list is the set of MapDescription.Tiles, explicit lists
+	// are the only tiles kept in memory.
+	list   *geography.TileSet
+	shard  int
+	shards int
+}
+
+func newJobTiles(mapDesc MapDescription, params DownloadParams, registry *Registry) (*jobTiles, error) {
+	mapProj, ok := registry.Lookup(mapDesc.Provider)
+	if !ok {
+		return nil, fmt.Errorf("createTasks: bad map provider %s", mapDesc.Provider)
+	}
+	t := &jobTiles{
+		converter: mapProj.Converter(),
+		layers:    mapDesc.Layers,
+		named:     len(mapDesc.Layers) != 0,
+		shard:     params.Shard,
+		shards:    params.Shards,
+	}
+	switch {
+	case len(mapDesc.Tiles) != 0:
+		t.list = geography.NewTileSet(mapDesc.Tiles...)
+	case !t.named:
+		t.layers = []AreaLayer{{
+			MapArea: mapDesc.MapArea,
+			Route:   mapDesc.Route,
+			Buffer:  mapDesc.Buffer,
+			MinZoom: mapDesc.MinZoom,
+			MaxZoom: mapDesc.MaxZoom,
+		}}
+	}
+	return t, nil
+}
+
+func (t *jobTiles) inShard(num geography.TileNum) bool {
+	return t.shards == 0 || ShardOf(num.Z, num.X, num.Y, t.shards) == t.shard
+}
+
+// zooms returns the zoom levels of the layers.
+func (t *jobTiles) zooms() (minZoom, maxZoom int) {
+	minZoom, maxZoom = MAX_ZOOM+1, MIN_ZOOM-1
+	for _, layer := range t.layers {
+		minZoom = min(minZoom, layer.MinZoom)
+		maxZoom = max(maxZoom, layer.MaxZoom)
+	}
+	return minZoom, maxZoom
+}
+
+// areas returns the tiles of the layers at the zoom level,
+// nil for layers without the zoom level.
+func (t *jobTiles) areas(z int) ([]tileArea, error) {
+	areas := make([]tileArea, len(t.layers))
+	for i, layer := range t.layers {
+		if z < layer.MinZoom || z > layer.MaxZoom {
+			continue
+		}
+		area, err := layer.tiles(z, t.converter)
+		if err != nil {
+			if t.named {
+				return nil, fmt.Errorf("Layer %q: %v", layer.Name, err)
+			}
+			return nil, err
+		}
+		areas[i] = area
+	}
+	return areas, nil
+}
+
+// each calls f for the tiles ordered by zoom levels until f returns
+// false. Tiles shared by layers are passed once, with indices of the
+// layers of the map having them.
+func (t *jobTiles) each(f func(num geography.TileNum, layers []int) bool) error {
+	if t.list != nil {
+		t.list.Each(func(num geography.TileNum) bool {
+			return !t.inShard(num) || f(num, nil)
+		})
+		return nil
+	}
+	minZoom, maxZoom := t.zooms()
+	for z := minZoom; z <= maxZoom; z++ {
+		areas, err := t.areas(z)
+		if err != nil {
+			return err
+		}
+		stopped := false
+		for i, area := range areas {
+			if area == nil {
+				continue
+			}
+			area.Each(func(num geography.TileNum) bool {
+				// The tile is passed with the first layer having it.
+				for _, other := range areas[:i] {
+					if other != nil && other.Contains(num.Z, num.X, num.Y) {
+						return true
+					}
+				}
+				if !t.inShard(num) {
+					return true
+				}
+				var layers []int
+				if t.named {
+					layers = append(layers, i)
+					for k := i + 1; k < len(areas); k++ {
+						if areas[k] != nil && areas[k].Contains(num.Z, num.X, num.Y) {
+							layers = append(layers, k)
+						}
+					}
+				}
+				stopped = !f(num, layers)
+				return !stopped
+			})
+			if stopped {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// totals returns the numbers of tiles of the layers of the map.
+func (t *jobTiles) totals() ([]int, error) {
+	totals := make([]int, len(t.layers))
+	minZoom, maxZoom := t.zooms()
+	for z := minZoom; z <= maxZoom; z++ {
+		areas, err := t.areas(z)
+		if err != nil {
+			return nil, err
+		}
+		for i, area := range areas {
+			switch {
+			case area == nil:
+			case t.shards == 0:
+				totals[i] += area.Len()
+			default:
+				area.Each(func(num geography.TileNum) bool {
+					if t.inShard(num) {
+						totals[i]++
+					}
+					return true
+				})
+			}
+		}
+	}
+	return totals, nil
+}
@@ -0,0 +1,56 @@
+package tiletest
+
+// font.go: tiny bitmap font for writing coordinates on tiles.
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	GLYPH_WIDTH  = 3
+	GLYPH_HEIGHT = 5
+	// Glyph pixels are drawn as GLYPH_SCALE x GLYPH_SCALE squares.
+	GLYPH_SCALE = 4
+)
+
+// Rows of glyphs from top to bottom, bits from left to right.
+var glyphs = map[rune][GLYPH_HEIGHT]uint8{
+	'0': {0x7, 0x5, 0x5, 0x5, 0x7},
+	'1': {0x2, 0x6, 0x2, 0x2, 0x7},
+	'2': {0x7, 0x1, 0x7, 0x4, 0x7},
+	'3': {0x7, 0x1, 0x7, 0x1, 0x7},
+	'4': {0x5, 0x5, 0x7, 0x1, 0x1},
+	'5': {0x7, 0x4, 0x7, 0x1, 0x7},
+	'6': {0x7, 0x4, 0x7, 0x5, 0x7},
+	'7': {0x7, 0x1, 0x1, 0x1, 0x1},
+	'8': {0x7, 0x5, 0x7, 0x5, 0x7},
+	'9': {0x7, 0x5, 0x7, 0x1, 0x7},
+	'/': {0x1, 0x1, 0x2, 0x4, 0x4},
+	'-': {0x0, 0x0, 0x7, 0x0, 0x0},
+}
+
+// drawText writes text in the middle of img.
+func drawText(img *image.RGBA, text string, c color.Color) {
+	advance := (GLYPH_WIDTH + 1) * GLYPH_SCALE
+	bounds := img.Bounds()
+	left := bounds.Min.X + (bounds.Dx()-len(text)*advance)/2
+	top := bounds.Min.Y + (bounds.Dy()-GLYPH_HEIGHT*GLYPH_SCALE)/2
+	for i, r := range text {
+		glyph := glyphs[r]
+		for row := 0; row < GLYPH_HEIGHT; row++ {
+			for col := 0; col < GLYPH_WIDTH; col++ {
+				if glyph[row]&(1<<uint(GLYPH_WIDTH-1-col)) == 0 {
+					continue
+				}
+				x0 := left + i*advance + col*GLYPH_SCALE
+				y0 := top + row*GLYPH_SCALE
+				for dy := 0; dy < GLYPH_SCALE; dy++ {
+					for dx := 0; dx < GLYPH_SCALE; dx++ {
+						img.Set(x0+dx, y0+dy, c)
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Package tiletest provides a local tile server for tests.
+package tiletest
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TILE_SIZE = 256
+	// Tiles are served at URL_TEMPLATE relative to the server URL.
+	URL_TEMPLATE = "/{z}/{x}/{y}.png"
+	// Bodies are written in SLOW_CHUNKS parts with SlowBody.
+	SLOW_CHUNKS = 8
+)
+
+type Params struct {
+	// Latency delays every response.
+	Latency time.Duration
+	// ErrorRate is the share of requests failed with 500.
+	ErrorRate float64
+	// ThrottleRate is the share of requests failed with 429 and
+	// Retry-After set to RetryAfter.
+	ThrottleRate float64
+	RetryAfter   time.Duration
+	// Placeholder tells which tiles have no imagery, Placeholder()
+	// is served for them.
+	Placeholder func(z, x, y int) bool
+	// SlowBody is how long writing of every body takes.
+	SlowBody time.Duration
+	// Seed makes the choice of failed requests reproducible.
+	Seed int64
+}
+
+// Server serves deterministic PNG tiles with z/x/y drawn on them.
+type Server struct {
+	*httptest.Server
+	params Params
+
+	mtx      sync.Mutex
+	random   *rand.Rand
+	statuses map[int]int
+}
+
+// NewServer starts the server, it must be closed with Close.
+func NewServer(params Params) *Server {
+	s := &Server{
+		params:   params,
+		random:   rand.New(rand.NewSource(params.Seed)),
+		statuses: make(map[int]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Template returns the URL template of tiles with {z}, {x}
+// and {y} placeholders.
+func (s *Server) Template() string {
+	return s.URL + URL_TEMPLATE
+}
+
+// Requests returns the number of responses with the status.
+func (s *Server) Requests(status int) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.statuses[status]
+}
+
+func (s *Server) respond(w http.ResponseWriter, status int) {
+	s.mtx.Lock()
+	s.statuses[status]++
+	s.mtx.Unlock()
+	w.WriteHeader(status)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	var z, x, y int
+	if _, err := fmt.Sscanf(r.URL.Path, "/%d/%d/%d.png", &z, &x, &y); err != nil {
+		s.respond(w, http.StatusNotFound)
+		return
+	}
+	if s.params.Latency > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(s.params.Latency):
+		}
+	}
+	s.mtx.Lock()
+	dice := s.random.Float64()
+	s.mtx.Unlock()
+	switch {
+	case dice < s.params.ErrorRate:
+		s.respond(w, http.StatusInternalServerError)
+		return
+	case dice < s.params.ErrorRate+s.params.ThrottleRate:
+		seconds := int(s.params.RetryAfter / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		s.respond(w, http.StatusTooManyRequests)
+		return
+	}
+	var content []byte
+	if s.params.Placeholder != nil && s.params.Placeholder(z, x, y) {
+		content = Placeholder()
+	} else {
+		content = Tile(z, x, y)
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	s.respond(w, http.StatusOK)
+	if s.params.SlowBody <= 0 {
+		w.Write(content)
+		return
+	}
+	chunk := (len(content) + SLOW_CHUNKS - 1) / SLOW_CHUNKS
+	for len(content) > 0 {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(s.params.SlowBody / SLOW_CHUNKS):
+		}
+		n := min(chunk, len(content))
+		if _, err := w.Write(content[:n]); err != nil {
+			return
+		}
+		w.(http.Flusher).Flush()
+		content = content[n:]
+	}
+}
+
+func encode(img image.Image) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Placeholder returns the tile served where there is no imagery.
+func Placeholder() []byte {
+	img := image.NewGray(image.Rect(0, 0, TILE_SIZE, TILE_SIZE))
+	for i := range img.Pix {
+		img.Pix[i] = 0xdd
+	}
+	return encode(img)
+}
+
+// Tile returns the image of the tile, its background color depends
+// on the coordinates and they are written in the middle.
+func Tile(z, x, y int) []byte {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d/%d/%d", z, x, y)
+	sum := h.Sum32()
+	background := color.RGBA{
+		R: 128 + uint8(sum)%128,
+		G: 128 + uint8(sum>>8)%128,
+		B: 128 + uint8(sum>>16)%128,
+		A: 0xff,
+	}
+	img := image.NewRGBA(image.Rect(0, 0, TILE_SIZE, TILE_SIZE))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i] = background.R
+		img.Pix[i+1] = background.G
+		img.Pix[i+2] = background.B
+		img.Pix[i+3] = background.A
+	}
+	drawText(img, fmt.Sprintf("%d/%d/%d", z, x, y), color.Black)
+	return encode(img)
+}
@@ -0,0 +1,83 @@
+package tiletest
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, url string) (*http.Response, []byte) {
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Server: request failed: %v.", err)
+	}
+	defer res.Body.Close()
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("Server: failed to read body: %v.", err)
+	}
+	return res, content
+}
+
+func TestTiles(t *testing.T) {
+	server := NewServer(Params{
+		Placeholder: func(z, x, y int) bool { return x == 0 },
+		SlowBody:    80 * time.Millisecond,
+	})
+	defer server.Close()
+	start := time.Now()
+	res, content := get(t, server.URL+"/14/9868/5175.png")
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("Server: slow body was written in %v.", elapsed)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server: got status %d.", res.StatusCode)
+	}
+	if !bytes.Equal(content, Tile(14, 9868, 5175)) {
+		t.Errorf("Server: tile is not deterministic.")
+	}
+	img, err := png.Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatalf("Server: tile is not PNG: %v.", err)
+	}
+	if size := img.Bounds().Dx(); size != TILE_SIZE {
+		t.Errorf("Server: tile size is %d.", size)
+	}
+	if bytes.Equal(content, Tile(14, 9868, 5176)) {
+		t.Errorf("Server: different tiles have the same image.")
+	}
+	_, content = get(t, server.URL+"/14/0/5175.png")
+	if !bytes.Equal(content, Placeholder()) {
+		t.Errorf("Server: placeholder was not served.")
+	}
+	res, _ = get(t, server.URL+"/bad")
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Server: got status %d for bad path.", res.StatusCode)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	server := NewServer(Params{
+		ErrorRate:    0.2,
+		ThrottleRate: 0.2,
+		RetryAfter:   3 * time.Second,
+		Seed:         1,
+	})
+	defer server.Close()
+	for i := 0; i < 100; i++ {
+		res, _ := get(t, fmt.Sprintf("%s/10/%d/1.png", server.URL, i))
+		if res.StatusCode == http.StatusTooManyRequests && res.Header.Get("Retry-After") != "3" {
+			t.Errorf("Server: bad Retry-After %q.", res.Header.Get("Retry-After"))
+		}
+	}
+	ok := server.Requests(http.StatusOK)
+	failed := server.Requests(http.StatusInternalServerError)
+	throttled := server.Requests(http.StatusTooManyRequests)
+	if ok+failed+throttled != 100 || failed < 10 || failed > 30 || throttled < 10 || throttled > 30 {
+		t.Errorf("Server: %d ok, %d failed and %d throttled requests.", ok, failed, throttled)
+	}
+}
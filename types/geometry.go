@@ -19,6 +19,12 @@ type (
 		Vertices []Point `json:"vertices"`
 	}
 
+	// LineString is a path through the point list,
+	// e.g. a GPS track or a road.
+	LineString struct {
+		Points []Point `json:"points"`
+	}
+
 	// Custom types for sorting.
 	ByLatitude  []Point
 	ByLongitude []Point
@@ -54,10 +60,23 @@ func (p Polygon) ExtremeCoordinates() (minLat, minLong, maxLat, maxLong float64,
 	size := len(p.Vertices)
 	if size == 0 {
 		err = errors.New("Trying to apply ExtremeCoordinates to Polygon of 0 points.")
+		return
 	}
-	sort.Sort(ByLatitude(p.Vertices))
-	minLat, maxLat = p.Vertices[0].Latitude, p.Vertices[size-1].Latitude
-	sort.Sort(ByLongitude(p.Vertices))
-	minLong, maxLong = p.Vertices[0].Longitude, p.Vertices[size-1].Longitude
+	// Sort a copy, the polygon may be used concurrently.
+	vertices := append([]Point(nil), p.Vertices...)
+	sort.Sort(ByLatitude(vertices))
+	minLat, maxLat = vertices[0].Latitude, vertices[size-1].Latitude
+	sort.Sort(ByLongitude(vertices))
+	minLong, maxLong = vertices[0].Longitude, vertices[size-1].Longitude
 	return
 }
+
+// ExtremeCoordinates returns minimum and maximum values for
+// latitude and longitude.
+func (l LineString) ExtremeCoordinates() (minLat, minLong, maxLat, maxLong float64, err error) {
+	if len(l.Points) == 0 {
+		err = errors.New("Trying to apply ExtremeCoordinates to LineString of 0 points.")
+		return
+	}
+	return Polygon{Vertices: l.Points}.ExtremeCoordinates()
+}
@@ -29,3 +29,22 @@ func TestExtremeCoordinates(t *testing.T) {
 		t.Fatalf("ExtremeCoordinates: invalid maximum longitude.")
 	}
 }
+
+func TestLineStringExtremeCoordinates(t *testing.T) {
+	l := LineString{
+		Points: []Point{
+			Point{30.12300, 67.32320},
+			Point{40.21410, 20.32434},
+		},
+	}
+	minLat, minLong, maxLat, maxLong, err := l.ExtremeCoordinates()
+	if err != nil {
+		t.Fatalf("ExtremeCoordinates: %v.", err)
+	}
+	if minLat != 30.12300 || minLong != 20.32434 || maxLat != 40.21410 || maxLong != 67.32320 {
+		t.Fatalf("ExtremeCoordinates: invalid coordinates of LineString.")
+	}
+	if _, _, _, _, err := (LineString{}).ExtremeCoordinates(); err == nil {
+		t.Fatalf("ExtremeCoordinates: empty LineString was accepted.")
+	}
+}